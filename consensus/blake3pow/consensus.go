@@ -87,6 +87,19 @@ func (blake3pow *Blake3pow) VerifyHeader(chain consensus.ChainHeaderReader, head
 	return blake3pow.verifyHeader(chain, header, parent, false, time.Now().Unix())
 }
 
+// VerifyHeaderAgainst checks whether a header conforms to the consensus rules
+// of the stock Quai blake3pow engine, taking the given header as its parent.
+func (blake3pow *Blake3pow) VerifyHeaderAgainst(chain consensus.ChainHeaderReader, header, parent *types.Header) error {
+	// If we're running a full engine faking, accept any input as valid
+	if blake3pow.config.PowMode == ModeFullFake {
+		return nil
+	}
+	if parent.Hash() != header.ParentHash() {
+		return consensus.ErrUnknownAncestor
+	}
+	return blake3pow.verifyHeader(chain, header, parent, false, time.Now().Unix())
+}
+
 // VerifyHeaders is similar to VerifyHeader, but verifies a batch of headers
 // concurrently. The method returns a quit channel to abort the operations and
 // a results channel to retrieve the async verifications.
@@ -384,6 +397,12 @@ func (blake3pow *Blake3pow) IsDomCoincident(chain consensus.ChainHeaderReader, h
 	return order < common.NodeLocation.Context()
 }
 
+// VerifySeal implements consensus.Engine, checking whether the given header
+// satisfies the PoW difficulty requirements.
+func (blake3pow *Blake3pow) VerifySeal(header *types.Header) error {
+	return blake3pow.verifySeal(header)
+}
+
 // verifySeal checks whether a block satisfies the PoW difficulty requirements,
 // either using the usual blake3pow cache for it, or alternatively using a full DAG
 // to make remote mining fast.
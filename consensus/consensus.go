@@ -84,6 +84,10 @@ type Engine interface {
 	// via the VerifySeal method.
 	VerifyHeader(chain ChainHeaderReader, header *types.Header) error
 
+	// VerifyHeaderAgainst is similar to VerifyHeader, but verifies the header
+	// against the given parent instead of looking it up in the chain.
+	VerifyHeaderAgainst(chain ChainHeaderReader, header, parent *types.Header) error
+
 	// VerifyHeaders is similar to VerifyHeader, but verifies a batch of headers
 	// concurrently. The method returns a quit channel to abort the operations and
 	// a results channel to retrieve the async verifications (the order is that of
@@ -94,6 +98,10 @@ type Engine interface {
 	// rules of a given engine.
 	VerifyUncles(chain ChainReader, block *types.Block) error
 
+	// VerifySeal checks whether the proof-of-work of a header satisfies its
+	// difficulty, without looking at the rest of the chain.
+	VerifySeal(header *types.Header) error
+
 	// Prepare initializes the consensus fields of a block header according to the
 	// rules of a particular engine. The changes are executed inline.
 	Prepare(chain ChainHeaderReader, header *types.Header, parent *types.Header) error
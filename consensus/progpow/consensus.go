@@ -89,6 +89,19 @@ func (progpow *Progpow) VerifyHeader(chain consensus.ChainHeaderReader, header *
 	return progpow.verifyHeader(chain, header, parent, false, time.Now().Unix())
 }
 
+// VerifyHeaderAgainst checks whether a header conforms to the consensus rules
+// of the stock Quai progpow engine, taking the given header as its parent.
+func (progpow *Progpow) VerifyHeaderAgainst(chain consensus.ChainHeaderReader, header, parent *types.Header) error {
+	// If we're running a full engine faking, accept any input as valid
+	if progpow.config.PowMode == ModeFullFake {
+		return nil
+	}
+	if parent.Hash() != header.ParentHash() {
+		return consensus.ErrUnknownAncestor
+	}
+	return progpow.verifyHeader(chain, header, parent, false, time.Now().Unix())
+}
+
 // VerifyHeaders is similar to VerifyHeader, but verifies a batch of headers
 // concurrently. The method returns a quit channel to abort the operations and
 // a results channel to retrieve the async verifications.
@@ -408,6 +421,13 @@ func (progpow *Progpow) ComputePowLight(header *types.Header) (mixHash, powHash
 	return mixHash, powHash
 }
 
+// VerifySeal implements consensus.Engine, checking whether the given header
+// satisfies the PoW difficulty requirements.
+func (progpow *Progpow) VerifySeal(header *types.Header) error {
+	_, err := progpow.verifySeal(header)
+	return err
+}
+
 // verifySeal checks whether a block satisfies the PoW difficulty requirements,
 // either using the usual progpow cache for it, or alternatively using a full DAG
 // to make remote mining fast.
@@ -70,6 +70,32 @@ var (
 
 	// ErrBadBlockHash is returned when block being appended is in the badBlockHashes list
 	ErrBadBlockHash = errors.New("block hash exists in bad block hashes list")
+
+	// ErrMalformedLocation is returned when a block's location does not address a valid zone
+	ErrMalformedLocation = errors.New("block location is malformed")
+
+	// ErrBlockTooOld is returned when a block is too far below the current head to affect fork choice
+	ErrBlockTooOld = errors.New("block too old")
+
+	// ErrNoCanonicalHash is returned when no canonical block is known at a number
+	ErrNoCanonicalHash = errors.New("no canonical hash")
+
+	// ErrHeaderNotFound is returned when a requested header is missing
+	ErrHeaderNotFound = errors.New("header not found")
+
+	// ErrNonMonotonicTime is returned when a block is not newer than its parent under strict timestamps
+	ErrNonMonotonicTime = errors.New("block timestamp not after parent")
+
+	// ErrProtectedHeader is returned when a reorg would drop a protected header
+	// off the canonical chain
+	ErrProtectedHeader = errors.New("reorg drops protected header")
+
+	// ErrVerifyTimeout is returned when the consensus engine takes too long to
+	// verify an appended header
+	ErrVerifyTimeout = errors.New("header verification timed out")
+
+	// ErrCorruptHeader is returned when reading a header fails on corrupt data
+	ErrCorruptHeader = errors.New("header is corrupt")
 )
 
 // List of evm-call-message pre-checking errors. All state transition messages will
@@ -41,3 +41,23 @@ type ChainSideEvent struct {
 }
 
 type ChainHeadEvent struct{ Block *types.Block }
+
+// ReorgEvent is posted when the canonical chain is reorganised. Both chains are
+// ordered from the highest header down to the common ancestor (exclusive).
+type ReorgEvent struct {
+	OldChain []*types.Header
+	NewChain []*types.Header
+}
+
+// NewHeadEvent is posted whenever the current header changes. Reorg is set if
+// reaching the new head dropped headers off the canonical chain, Depth being
+// the number of headers dropped.
+type NewHeadEvent struct {
+	Header *types.Header
+	Reorg  bool
+	Depth  int
+}
+
+// HeadsChangeEvent is posted when the set of tracked heads changes, carrying
+// the hashes of the heads ordered by number.
+type HeadsChangeEvent struct{ Heads []common.Hash }
@@ -1,10 +1,14 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,9 +20,11 @@ import (
 	"github.com/dominant-strategies/go-quai/core/state"
 	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/core/vm"
+	"github.com/dominant-strategies/go-quai/crypto"
 	"github.com/dominant-strategies/go-quai/ethdb"
 	"github.com/dominant-strategies/go-quai/event"
 	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/metrics"
 	"github.com/dominant-strategies/go-quai/params"
 	"github.com/dominant-strategies/go-quai/rlp"
 	"github.com/dominant-strategies/go-quai/trie"
@@ -28,7 +34,40 @@ import (
 const (
 	headerCacheLimit      = 512
 	numberCacheLimit      = 2048
+	ancestorCacheLimit    = 256
+	blockHashesCacheLimit = 64
+	canonicalBlockLimit   = 32
 	primeHorizonThreshold = 20
+	headsChangeInterval   = 100 * time.Millisecond
+	maxReorgDepth         = 1024 // Depth below the current head past which appended blocks are rejected
+	prefetchWorkers       = 4
+	ancestorMaxNonCanon   = 128 // Non-canonical blocks GetAncestorHeader may walk before giving up
+	dbReadRetries         = 3   // Attempts of a failing database read before the error is surfaced
+	dbReadRetryDelay      = 10 * time.Millisecond
+	parentWaitInterval    = 10 * time.Millisecond
+)
+
+var (
+	bodyCacheHitMeter  = metrics.NewRegisteredMeter("chain/body/cache/hit", nil)
+	bodyCacheMissMeter = metrics.NewRegisteredMeter("chain/body/cache/miss", nil)
+
+	appendTimer   = metrics.NewRegisteredTimer("chain/append/time", nil)
+	headLockTimer = metrics.NewRegisteredTimer("chain/headlock/wait", nil)
+	headsGauge    = metrics.NewRegisteredGauge("chain/heads/depth", nil)
+
+	blockReorgMeter     = metrics.NewRegisteredMeter("chain/reorg/executes", nil)
+	blockReorgAddMeter  = metrics.NewRegisteredMeter("chain/reorg/add", nil)
+	blockReorgDropMeter = metrics.NewRegisteredMeter("chain/reorg/drop", nil)
+
+	pruneHeadersMeter = metrics.NewRegisteredMeter("chain/prune/headers", nil)
+
+	appendRejectLocationCounter      = metrics.NewRegisteredCounter("chain/append/reject/location", nil)
+	appendRejectTooOldCounter        = metrics.NewRegisteredCounter("chain/append/reject/tooold", nil)
+	appendRejectPolicyCounter        = metrics.NewRegisteredCounter("chain/append/reject/policy", nil)
+	appendRejectUnknownParentCounter = metrics.NewRegisteredCounter("chain/append/reject/unknownparent", nil)
+	appendRejectNonContiguousCounter = metrics.NewRegisteredCounter("chain/append/reject/noncontiguous", nil)
+	appendRejectBadHeaderCounter     = metrics.NewRegisteredCounter("chain/append/reject/badheader", nil)
+	appendRejectNonMonotonicCounter  = metrics.NewRegisteredCounter("chain/append/reject/nonmonotonic", nil)
 )
 
 type HeaderChain struct {
@@ -38,17 +77,24 @@ type HeaderChain struct {
 	engine consensus.Engine
 	pool   *TxPool
 
-	chainHeadFeed event.Feed
-	chainSideFeed event.Feed
-	scope         event.SubscriptionScope
+	chainHeadFeed   event.Feed
+	chainSideFeed   event.Feed
+	reorgFeed       event.Feed
+	headsChangeFeed event.Feed
+	newHeadFeed     event.Feed
+	scope           event.SubscriptionScope
 
 	headerDb      ethdb.Database
 	genesisHeader *types.Header
 
 	currentHeader atomic.Value // Current head of the header chain (may be above the block chain!)
 
-	headerCache *lru.Cache // Cache for the most recent block headers
-	numberCache *lru.Cache // Cache for the most recent block numbers
+	headerCache   *lru.Cache // Cache for the most recent block headers
+	numberCache   *lru.Cache // Cache for the most recent block numbers
+	ancestorCache *lru.Cache // Cache for non-canonical ancestor lookups
+
+	blockHashesCache *lru.Cache // Cache for the hash lists returned by GetBlockHashesFromHash
+	canonicalBlocks  *lru.Cache // Cache for the most recent canonical blocks by number
 
 	pendingEtxsRollup            *lru.Cache
 	pendingEtxs                  *lru.Cache
@@ -56,12 +102,32 @@ type HeaderChain struct {
 	missingPendingEtxsFeed       event.Feed
 	missingPendingEtxsRollupFeed event.Feed
 
+	quit          chan struct{}  // shutdown signal, closed when Stop is called
 	wg            sync.WaitGroup // chain processing wait group for shutting down
 	running       int32          // 0 if chain is running, 1 when stopped
 	procInterrupt int32          // interrupt signaler for block processing
 
+	strictHeaderCache int32 // 1 if cached headers are checked against the requested number
+
 	headermu sync.RWMutex
 	heads    []*types.Header
+
+	headsChangeInterval time.Duration // Minimum interval between heads change events
+	headsChangeSent     time.Time     // Time the last heads change event was sent
+	headsChangePending  bool          // Whether a throttled heads change event is scheduled
+	headsChangeTimer    *time.Timer   // Timer posting the scheduled heads change event
+
+	exportReportInterval time.Duration // Interval between export progress logs, zero disables them
+
+	appendPolicy      func(*types.Header) error // Optional predicate rejecting headers before verification
+	parentWaitTimeout time.Duration             // Time an appended block may wait for its parent, zero disables waiting
+
+	writeBatchSize   int           // Number of items bulk operations write per database batch
+	strictTimestamps bool          // Whether appended blocks must be strictly newer than their parent
+	verifyTimeout    time.Duration // Time the engine may take to verify an appended header, zero for no limit
+	warmHeaders      int           // Number of recent canonical headers to load into the cache on startup
+
+	protectedHashes map[common.Hash]bool // Finalized headers no reorg may drop off the canonical chain
 }
 
 // NewHeaderChain creates a new HeaderChain structure. ProcInterrupt points
@@ -69,13 +135,33 @@ type HeaderChain struct {
 func NewHeaderChain(db ethdb.Database, engine consensus.Engine, chainConfig *params.ChainConfig, cacheConfig *CacheConfig, txLookupLimit *uint64, vmConfig vm.Config) (*HeaderChain, error) {
 	headerCache, _ := lru.New(headerCacheLimit)
 	numberCache, _ := lru.New(numberCacheLimit)
+	ancestorCache, _ := lru.New(ancestorCacheLimit)
+	blockHashesCache, _ := lru.New(blockHashesCacheLimit)
+	canonicalBlocks, _ := lru.New(canonicalBlockLimit)
 
 	hc := &HeaderChain{
-		config:      chainConfig,
-		headerDb:    db,
-		headerCache: headerCache,
-		numberCache: numberCache,
-		engine:      engine,
+		config:               chainConfig,
+		headerDb:             db,
+		headerCache:          headerCache,
+		numberCache:          numberCache,
+		ancestorCache:        ancestorCache,
+		blockHashesCache:     blockHashesCache,
+		canonicalBlocks:      canonicalBlocks,
+		engine:               engine,
+		exportReportInterval: statsReportLimit,
+		writeBatchSize:       defaultCacheConfig.WriteBatchSize,
+		headsChangeInterval:  headsChangeInterval,
+		quit:                 make(chan struct{}),
+	}
+	if cacheConfig != nil && cacheConfig.WriteBatchSize > 0 {
+		hc.writeBatchSize = cacheConfig.WriteBatchSize
+	}
+	if cacheConfig != nil {
+		hc.strictTimestamps = cacheConfig.StrictTimestamps
+		hc.verifyTimeout = cacheConfig.VerifyTimeout
+		hc.parentWaitTimeout = cacheConfig.ParentWaitTimeout
+		hc.warmHeaders = cacheConfig.WarmHeaders
+		hc.protectedHashes = cacheConfig.ProtectedHashes
 	}
 
 	pendingEtxsRollup, _ := lru.New(c_maxPendingEtxsRollup)
@@ -88,13 +174,13 @@ func NewHeaderChain(db ethdb.Database, engine consensus.Engine, chainConfig *par
 	hc.blooms = blooms
 
 	hc.genesisHeader = hc.GetHeaderByNumber(0)
-	if hc.genesisHeader.Hash() != chainConfig.GenesisHash {
-		return nil, fmt.Errorf("genesis block mismatch: have %x, want %x", hc.genesisHeader.Hash(), chainConfig.GenesisHash)
-	}
-	log.Info("Genesis", "Hash:", hc.genesisHeader.Hash())
 	if hc.genesisHeader == nil {
 		return nil, ErrNoGenesis
 	}
+	if hc.genesisHeader.Hash() != chainConfig.GenesisHash {
+		return nil, &GenesisMismatchError{Stored: hc.genesisHeader.Hash(), New: chainConfig.GenesisHash}
+	}
+	log.Info("Genesis", "Hash:", hc.genesisHeader.Hash())
 	//Load any state that is in our db
 	if err := hc.loadLastState(); err != nil {
 		return nil, err
@@ -106,10 +192,6 @@ func NewHeaderChain(db ethdb.Database, engine consensus.Engine, chainConfig *par
 		return nil, err
 	}
 
-	// Initialize the heads slice
-	heads := make([]*types.Header, 0)
-	hc.heads = heads
-
 	return hc, nil
 }
 
@@ -275,14 +357,100 @@ func (hc *HeaderChain) collectInclusiveEtxRollup(b *types.Block) (types.Transact
 	return etxRollup, nil
 }
 
-// Append
+// Append verifies the block and writes it, along with the state its processing
+// produces, into the given batch. Callers must call CommitBlock once the batch
+// is written, or the block is never tracked as a head nor announced.
 func (hc *HeaderChain) Append(batch ethdb.Batch, block *types.Block, newInboundEtxs types.Transactions) error {
+	_, err := hc.AppendAndCollect(batch, block, newInboundEtxs)
+	return err
+}
+
+// AppendAndCollect appends the block like Append does, additionally returning
+// the logs produced by processing it, which are to be passed to CommitBlock.
+func (hc *HeaderChain) AppendAndCollect(batch ethdb.Batch, block *types.Block, newInboundEtxs types.Transactions) ([]*types.Log, error) {
+	return hc.appendBlock(batch, block, newInboundEtxs, true)
+}
+
+// AppendVerified appends a block whose header the caller has already verified
+// with the consensus engine, skipping that verification. Only the presence of
+// the parent at the preceding number is checked instead. It is meant for
+// trusted internal callers only and must never be fed blocks from the network.
+// As with Append, CommitBlock must be called once the batch is written.
+func (hc *HeaderChain) AppendVerified(batch ethdb.Batch, block *types.Block, newInboundEtxs types.Transactions) error {
+	_, err := hc.appendBlock(batch, block, newInboundEtxs, false)
+	return err
+}
+
+// appendBlock appends the block, verifying its header with the consensus engine
+// if verify is set, and returns the logs produced by processing it.
+func (hc *HeaderChain) appendBlock(batch ethdb.Batch, block *types.Block, newInboundEtxs types.Transactions, verify bool) ([]*types.Log, error) {
+	defer appendTimer.UpdateSince(time.Now())
+
 	nodeCtx := common.NodeLocation.Context()
-	log.Debug("HeaderChain Append:", "Block information: Hash:", block.Hash(), "block header hash:", block.Header().Hash(), "Number:", block.NumberU64(), "Location:", block.Header().Location, "Parent:", block.ParentHash())
+	log.Debug("HeaderChain Append:", "Block information: Hash:", block.Hash(), "block header hash:", block.Header().Hash(), "Number:", block.NumberU64(), "Location:", block.Header().Location(), "Parent:", block.ParentHash())
+
+	// Dom chains index their subordinates by the block location, so a block
+	// which does not address a valid zone cannot be appended
+	if nodeCtx != common.ZONE_CTX {
+		if err := hc.CheckLocationRange(block.Location()); err != nil {
+			appendRejectLocationCounter.Inc(1)
+			return nil, ErrMalformedLocation
+		}
+	}
 
-	err := hc.engine.VerifyHeader(hc, block.Header())
-	if err != nil {
-		return err
+	// Blocks this far below the head cannot affect fork choice anymore, so
+	// replays of them are dropped before any verification work
+	if head := hc.CurrentHeader().NumberU64(); head > maxReorgDepth && block.NumberU64() < head-maxReorgDepth {
+		appendRejectTooOldCounter.Inc(1)
+		return nil, ErrBlockTooOld
+	}
+
+	hc.headermu.RLock()
+	policy := hc.appendPolicy
+	hc.headermu.RUnlock()
+	if policy != nil {
+		if err := policy(block.Header()); err != nil {
+			appendRejectPolicyCounter.Inc(1)
+			return nil, err
+		}
+	}
+
+	// Direct callers appending concurrently may opt into giving a parent still
+	// in flight on another goroutine the chance to land before rejecting its
+	// child. The slice never needs this, as its termini check already rejects
+	// blocks whose parent is not stored.
+	if !hc.waitForParent(block) {
+		appendRejectUnknownParentCounter.Inc(1)
+		return nil, consensus.ErrUnknownAncestor
+	}
+
+	if verify {
+		if err := hc.verifyHeader(block.Header()); err != nil {
+			verifyRejectCounter(err).Inc(1)
+			return nil, err
+		}
+	} else if block.NumberU64() == 0 {
+		appendRejectUnknownParentCounter.Inc(1)
+		return nil, consensus.ErrUnknownAncestor
+	} else {
+		// Without the engine only the parent vouches for the number, and the
+		// header lookups answer from the caches regardless of the number asked
+		parent := hc.GetHeaderByHash(block.ParentHash())
+		if parent == nil {
+			appendRejectUnknownParentCounter.Inc(1)
+			return nil, consensus.ErrUnknownAncestor
+		}
+		if parent.NumberU64() != block.NumberU64()-1 {
+			appendRejectNonContiguousCounter.Inc(1)
+			return nil, consensus.ErrInvalidNumber
+		}
+	}
+	if hc.strictTimestamps && block.NumberU64() > 0 {
+		parent := hc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+		if parent != nil && block.Time() <= parent.Time() {
+			appendRejectNonMonotonicCounter.Inc(1)
+			return nil, ErrNonMonotonicTime
+		}
 	}
 
 	collectBlockManifest := time.Now()
@@ -294,10 +462,10 @@ func (hc *HeaderChain) Append(batch ethdb.Batch, block *types.Block, newInboundE
 	if nodeCtx > common.PRIME_CTX {
 		manifest := rawdb.ReadManifest(hc.headerDb, block.ParentHash())
 		if manifest == nil {
-			return errors.New("manifest not found for parent")
+			return nil, errors.New("manifest not found for parent")
 		}
 		if block.ManifestHash(nodeCtx) != types.DeriveSha(manifest, trie.NewStackTrie(nil)) {
-			return errors.New("manifest does not match hash")
+			return nil, errors.New("manifest does not match hash")
 		}
 	}
 	elapsedCollectBlockManifest := common.PrettyDuration(time.Since(collectBlockManifest))
@@ -309,21 +477,361 @@ func (hc *HeaderChain) Append(batch ethdb.Batch, block *types.Block, newInboundE
 	// Append block else revert header append
 	logs, err := hc.bc.Append(batch, block, newInboundEtxs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Info("Time taken to", "collectBlockManifest", elapsedCollectBlockManifest, "Append in bc", common.PrettyDuration(time.Since(blockappend)))
 
+	return logs, nil
+}
+
+// CommitBlock tracks an appended block as a head and announces it along with
+// the logs its processing produced. It must only be called once the batch the
+// block was appended to has been written, so that no head or event refers to a
+// block which never made it to the database.
+func (hc *HeaderChain) CommitBlock(block *types.Block, logs []*types.Log) {
+	lockStart := time.Now()
+	hc.headermu.Lock()
+	headLockTimer.UpdateSince(lockStart)
+	changed := hc.addHead(block.Header())
+	hc.headermu.Unlock()
+	if changed {
+		hc.notifyHeadsChange()
+	}
+
 	hc.bc.chainFeed.Send(ChainEvent{Block: block, Hash: block.Hash(), Logs: logs})
 	if len(logs) > 0 {
 		hc.bc.logsFeed.Send(logs)
 	}
+}
 
-	return nil
+// verifyHeader verifies the header with the consensus engine, giving up with
+// ErrVerifyTimeout once verifyTimeout has passed.
+func (hc *HeaderChain) verifyHeader(header *types.Header) error {
+	if hc.verifyTimeout == 0 {
+		return hc.engine.VerifyHeader(hc, header)
+	}
+	// The result channel is buffered, so an abandoned verification still gets
+	// to deliver its result and exit
+	errc := make(chan error, 1)
+	go func() {
+		errc <- hc.engine.VerifyHeader(hc, header)
+	}()
+	timeout := time.NewTimer(hc.verifyTimeout)
+	defer timeout.Stop()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-timeout.C:
+		return ErrVerifyTimeout
+	}
+}
+
+// waitForParent polls for the parent of the given block to be stored, for at
+// most parentWaitTimeout, which is disabled by default. It reports whether the
+// parent is present, which the genesis block is considered to always be.
+func (hc *HeaderChain) waitForParent(block *types.Block) bool {
+	if block.NumberU64() == 0 || hc.HasHeader(block.ParentHash(), block.NumberU64()-1) {
+		return true
+	}
+	if hc.parentWaitTimeout == 0 {
+		return false
+	}
+	timeout := time.NewTimer(hc.parentWaitTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(parentWaitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if hc.HasHeader(block.ParentHash(), block.NumberU64()-1) {
+				return true
+			}
+		case <-timeout.C:
+			return false
+		case <-hc.quit:
+			return false
+		}
+	}
+}
+
+// verifyRejectCounter maps a header verification error to the counter of the
+// matching rejection reason. Errors without a dedicated counter, such as bad
+// seals, are accounted as bad headers.
+func verifyRejectCounter(err error) metrics.Counter {
+	switch {
+	case errors.Is(err, consensus.ErrUnknownAncestor):
+		return appendRejectUnknownParentCounter
+	case errors.Is(err, consensus.ErrInvalidNumber):
+		return appendRejectNonContiguousCounter
+	default:
+		return appendRejectBadHeaderCounter
+	}
+}
+
+// SetAppendPolicy sets a predicate consulted for every appended block before
+// the consensus engine verifies it. A non-nil error returned by the policy
+// rejects the block. A nil policy accepts every block.
+func (hc *HeaderChain) SetAppendPolicy(policy func(*types.Header) error) {
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
+
+	hc.appendPolicy = policy
+}
+
+// addHead tracks the header as the tip of its branch, replacing its parent if
+// the parent was a tracked head. Headers which are already tracked are ignored.
+// The heads are kept sorted by number, ties broken by hash, and capped at
+// maxHeadsQueueLimit by dropping the lowest ones. It reports whether the heads
+// changed. This method assumes that the headermu is held.
+func (hc *HeaderChain) addHead(header *types.Header) bool {
+	hash := header.Hash()
+	heads := make([]*types.Header, 0, len(hc.heads)+1)
+	for _, head := range hc.heads {
+		if head.Hash() == hash {
+			return false
+		}
+		if head.Hash() != header.ParentHash() {
+			heads = append(heads, head)
+		}
+	}
+	heads = append(heads, header)
+	sort.SliceStable(heads, func(i, j int) bool {
+		if numberI, numberJ := heads[i].NumberU64(), heads[j].NumberU64(); numberI != numberJ {
+			return numberI < numberJ
+		}
+		hashI, hashJ := heads[i].Hash(), heads[j].Hash()
+		return bytes.Compare(hashI[:], hashJ[:]) < 0
+	})
+	if len(heads) > maxHeadsQueueLimit {
+		heads = heads[len(heads)-maxHeadsQueueLimit:]
+	}
+	hc.heads = heads
+	headsGauge.Update(int64(len(heads)))
+	return true
+}
+
+// notifyHeadsChange posts a heads change event, throttled to one event per
+// headsChangeInterval. Changes within the interval are coalesced into a single
+// event sent once it elapses, carrying the heads at that time.
+func (hc *HeaderChain) notifyHeadsChange() {
+	hc.headermu.Lock()
+	if hc.headsChangePending || hc.stopping() {
+		hc.headermu.Unlock()
+		return
+	}
+	if wait := hc.headsChangeInterval - time.Since(hc.headsChangeSent); wait > 0 {
+		// The timer is tracked by the wait group, so Stop either cancels it or
+		// waits for its event to be sent
+		hc.headsChangePending = true
+		hc.wg.Add(1)
+		hc.headsChangeTimer = time.AfterFunc(wait, func() {
+			defer hc.wg.Done()
+			hc.sendHeadsChange()
+		})
+		hc.headermu.Unlock()
+		return
+	}
+	hc.headermu.Unlock()
+	hc.sendHeadsChange()
+}
+
+// stopping reports whether Stop has been called.
+func (hc *HeaderChain) stopping() bool {
+	select {
+	case <-hc.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendHeadsChange posts the current heads on the heads change feed, unless the
+// chain is stopping.
+func (hc *HeaderChain) sendHeadsChange() {
+	hc.headermu.Lock()
+	if hc.stopping() {
+		hc.headermu.Unlock()
+		return
+	}
+	hc.headsChangePending = false
+	hc.headsChangeSent = time.Now()
+	hashes := make([]common.Hash, len(hc.heads))
+	for i, head := range hc.heads {
+		hashes[i] = head.Hash()
+	}
+	hc.headermu.Unlock()
+
+	// Feed sends may block on slow subscribers, so never send under the lock
+	hc.headsChangeFeed.Send(HeadsChangeEvent{Heads: hashes})
+}
+
+// PruneOrphans deletes the blocks stored below the given number which are not
+// reachable from the current header or any of the tracked heads, such as those
+// of branches dropped by reorgs, along with the lookups of their transactions.
+// Deletions are flushed to the database every writeBatchSize blocks. It returns
+// the number of blocks removed.
+func (hc *HeaderChain) PruneOrphans(belowNumber uint64) (int, error) {
+	// Scan for orphans without holding up appends and reorgs. These can only
+	// make more blocks reachable meanwhile, which is caught up on right before
+	// deleting.
+	hc.headermu.RLock()
+	tips := append([]*types.Header{hc.CurrentHeader()}, hc.heads...)
+	hc.headermu.RUnlock()
+
+	reachable := make(map[common.Hash]struct{})
+	hc.markReachable(reachable, tips)
+
+	type orphan struct {
+		hash   common.Hash
+		number uint64
+	}
+	var orphans []orphan
+	for nr := uint64(0); nr < belowNumber; nr++ {
+		for _, hash := range rawdb.ReadAllHashes(hc.headerDb, nr) {
+			if _, ok := reachable[hash]; ok || hash == hc.config.GenesisHash {
+				continue
+			}
+			orphans = append(orphans, orphan{hash: hash, number: nr})
+		}
+	}
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
+
+	hc.markReachable(reachable, append([]*types.Header{hc.CurrentHeader()}, hc.heads...))
+
+	var (
+		nodeCtx   = common.NodeLocation.Context()
+		batch     = hc.headerDb.NewBatch()
+		pruned    = 0
+		prunedTxs []common.Hash
+	)
+	for _, orphan := range orphans {
+		if _, ok := reachable[orphan.hash]; ok {
+			continue
+		}
+		// Only zones index transactions. A lookup is only dropped if it does not
+		// resolve, as the transaction may also be included on the canonical chain.
+		if nodeCtx == common.ZONE_CTX {
+			if body := rawdb.ReadBody(hc.headerDb, orphan.hash, orphan.number); body != nil {
+				for _, tx := range body.Transactions {
+					if found, _, _, _ := rawdb.ReadTransaction(hc.headerDb, tx.Hash()); found == nil {
+						rawdb.DeleteTxLookupEntry(batch, tx.Hash())
+						prunedTxs = append(prunedTxs, tx.Hash())
+					}
+				}
+			}
+		}
+		rawdb.DeleteBlock(batch, orphan.hash, orphan.number)
+		rawdb.DeleteTermini(batch, orphan.hash)
+		rawdb.DeleteEtxSet(batch, orphan.hash, orphan.number)
+
+		hc.headerCache.Remove(orphan.hash)
+		hc.numberCache.Remove(orphan.hash)
+		hc.bc.blockCache.Remove(orphan.hash)
+		hc.bc.bodyCache.Remove(orphan.hash)
+		hc.bc.bodyRLPCache.Remove(orphan.hash)
+		pruned++
+
+		if pruned%hc.writeBatchSize == 0 {
+			if err := batch.Write(); err != nil {
+				return 0, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	// Cached ancestors and hash lists may lead through any of the pruned blocks
+	if pruned > 0 {
+		hc.ancestorCache.Purge()
+		hc.blockHashesCache.Purge()
+	}
+	if hc.bc.processor != nil {
+		for _, hash := range prunedTxs {
+			hc.bc.processor.txLookupCache.Remove(hash)
+		}
+	}
+	pruneHeadersMeter.Mark(int64(pruned))
+	log.Debug("Pruned orphaned blocks", "below", belowNumber, "head", hc.CurrentHeader().Hash(), "count", pruned)
+	return pruned, nil
+}
+
+// markReachable adds every block reachable from the given tips to reachable,
+// stopping the walk back from each tip at the first block already in it.
+func (hc *HeaderChain) markReachable(reachable map[common.Hash]struct{}, tips []*types.Header) {
+	for _, tip := range tips {
+		for header := tip; header != nil; {
+			if _, ok := reachable[header.Hash()]; ok {
+				break
+			}
+			reachable[header.Hash()] = struct{}{}
+			if header.NumberU64() == 0 {
+				break
+			}
+			header = hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
+		}
+	}
+}
+
+// RepairNumberIndex rewrites the hash to number mappings of the canonical
+// headers numbered from first to last which disagree with their canonical
+// number, such as those left behind by interrupted reorgs. Numbers without a
+// stored canonical header are skipped. Writes are flushed to the database every
+// writeBatchSize entries. It returns the number of entries repaired.
+func (hc *HeaderChain) RepairNumberIndex(first, last uint64) (int, error) {
+	if first > last {
+		return 0, fmt.Errorf("repair failed: first (%d) is greater than last (%d)", first, last)
+	}
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
+
+	batch := hc.headerDb.NewBatch()
+	repaired := 0
+	for nr := first; nr <= last; nr++ {
+		hash := rawdb.ReadCanonicalHash(hc.headerDb, nr)
+		if hash == (common.Hash{}) || !rawdb.HasHeader(hc.headerDb, hash, nr) {
+			continue
+		}
+		if number := rawdb.ReadHeaderNumber(hc.headerDb, hash); number != nil && *number == nr {
+			continue
+		}
+		rawdb.WriteHeaderNumber(batch, hash, nr)
+		hc.numberCache.Remove(hash)
+		repaired++
+
+		if repaired%hc.writeBatchSize == 0 {
+			if err := batch.Write(); err != nil {
+				return 0, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	return repaired, nil
 }
 
 // SetCurrentHeader sets the in-memory head header marker of the canonical chan
 // as the given header.
 func (hc *HeaderChain) SetCurrentHeader(head *types.Header) error {
+	// Feed sends block until every subscriber has received the event, so the
+	// events are only sent once the header lock is released
+	var (
+		reorg   *ReorgEvent
+		newHead *NewHeadEvent
+	)
+	defer func() {
+		if reorg != nil {
+			hc.reorgFeed.Send(*reorg)
+		}
+		if newHead != nil {
+			hc.newHeadFeed.Send(*newHead)
+		}
+	}()
 	hc.headermu.Lock()
 	defer hc.headermu.Unlock()
 
@@ -336,16 +844,30 @@ func (hc *HeaderChain) SetCurrentHeader(head *types.Header) error {
 	commonHeader := hc.findCommonAncestor(head)
 	newHeader := head
 
-	// write the head block hash to the db
-	rawdb.WriteHeadBlockHash(hc.headerDb, head.Hash())
-	hc.currentHeader.Store(head)
+	// Refuse any reorg dropping a protected header, before touching the chain
+	if prevHeader.Hash() != head.ParentHash() && hc.dropsProtected(prevHeader, commonHeader) {
+		return ErrProtectedHeader
+	}
 
 	// If head is the normal extension of canonical head, we can return by just wiring the canonical hash.
 	if prevHeader.Hash() == head.ParentHash() {
+		rawdb.WriteHeadBlockHash(hc.headerDb, head.Hash())
+		hc.currentHeader.Store(head)
 		rawdb.WriteCanonicalHash(hc.headerDb, head.Hash(), head.NumberU64())
+		hc.canonicalBlocks.Remove(head.NumberU64())
+		newHead = &NewHeadEvent{Header: head}
 		return nil
 	}
 
+	// The canonical chain is about to change, so any ancestor or block resolved
+	// through the old canonical chain may be stale
+	hc.ancestorCache.Purge()
+	hc.canonicalBlocks.Purge()
+
+	// Only zones index the transactions of their blocks
+	nodeCtx := common.NodeLocation.Context()
+	batch := hc.headerDb.NewBatch()
+
 	// Delete each header and rollback state processor until common header
 	// Accumulate the hash slice stack
 	var hashStack []*types.Header
@@ -354,6 +876,9 @@ func (hc *HeaderChain) SetCurrentHeader(head *types.Header) error {
 			break
 		}
 		hashStack = append(hashStack, newHeader)
+		if newHeader.NumberU64() == 0 {
+			break
+		}
 		newHeader = hc.GetHeader(newHeader.ParentHash(), newHeader.NumberU64()-1)
 
 		// genesis check to not delete the genesis block
@@ -362,11 +887,26 @@ func (hc *HeaderChain) SetCurrentHeader(head *types.Header) error {
 		}
 	}
 
+	var (
+		deletedHeaders []*types.Header
+		deletedTxs     []common.Hash
+	)
 	for {
 		if prevHeader.Hash() == commonHeader.Hash() {
 			break
 		}
-		rawdb.DeleteCanonicalHash(hc.headerDb, prevHeader.NumberU64())
+		deletedHeaders = append(deletedHeaders, prevHeader)
+		rawdb.DeleteCanonicalHash(batch, prevHeader.NumberU64())
+		if nodeCtx == common.ZONE_CTX {
+			if block := hc.GetBlock(prevHeader.Hash(), prevHeader.NumberU64()); block != nil {
+				for _, tx := range block.Transactions() {
+					deletedTxs = append(deletedTxs, tx.Hash())
+				}
+			}
+		}
+		if prevHeader.NumberU64() == 0 {
+			break
+		}
 		prevHeader = hc.GetHeader(prevHeader.ParentHash(), prevHeader.NumberU64()-1)
 
 		// genesis check to not delete the genesis block
@@ -375,13 +915,67 @@ func (hc *HeaderChain) SetCurrentHeader(head *types.Header) error {
 		}
 	}
 
+	// Drop the lookups of the abandoned transactions before re-indexing the new
+	// branch, so transactions included on both branches keep their new entry
+	rawdb.DeleteTxLookupEntries(batch, deletedTxs)
+
 	// Run through the hash stack to update canonicalHash and forward state processor
+	var indexedTxs []common.Hash
 	for i := len(hashStack) - 1; i >= 0; i-- {
-		rawdb.WriteCanonicalHash(hc.headerDb, hashStack[i].Hash(), hashStack[i].NumberU64())
+		rawdb.WriteCanonicalHash(batch, hashStack[i].Hash(), hashStack[i].NumberU64())
+		if nodeCtx != common.ZONE_CTX {
+			continue
+		}
+		if block := hc.GetBlock(hashStack[i].Hash(), hashStack[i].NumberU64()); block != nil {
+			rawdb.WriteTxLookupEntriesByBlock(batch, block)
+			for _, tx := range block.Transactions() {
+				indexedTxs = append(indexedTxs, tx.Hash())
+			}
+		}
+	}
+	// The head moves along with the canonical chain it is written with
+	rawdb.WriteHeadBlockHash(batch, head.Hash())
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	hc.currentHeader.Store(head)
+
+	// Lookups served from the cache must follow the rewritten index
+	if nodeCtx == common.ZONE_CTX && hc.bc.processor != nil {
+		for _, hash := range append(deletedTxs, indexedTxs...) {
+			hc.bc.processor.txLookupCache.Remove(hash)
+		}
+	}
+	// Moving the head forward over several blocks at once drops nothing and
+	// is no reorg
+	if len(deletedHeaders) > 0 {
+		blockReorgMeter.Mark(1)
+		blockReorgAddMeter.Mark(int64(len(hashStack)))
+		blockReorgDropMeter.Mark(int64(len(deletedHeaders)))
+		reorg = &ReorgEvent{OldChain: deletedHeaders, NewChain: hashStack}
 	}
+	newHead = &NewHeadEvent{Header: head, Reorg: len(deletedHeaders) > 0, Depth: len(deletedHeaders)}
 	return nil
 }
 
+// dropsProtected reports whether any header from head back to, but excluding,
+// ancestor is protected against reorgs.
+func (hc *HeaderChain) dropsProtected(head, ancestor *types.Header) bool {
+	if len(hc.protectedHashes) == 0 {
+		return false
+	}
+	for head != nil && head.Hash() != ancestor.Hash() {
+		if hc.protectedHashes[head.Hash()] {
+			return true
+		}
+		if head.NumberU64() == 0 {
+			break
+		}
+		head = hc.GetHeader(head.ParentHash(), head.NumberU64()-1)
+	}
+	return false
+}
+
 // findCommonAncestor
 func (hc *HeaderChain) findCommonAncestor(header *types.Header) *types.Header {
 	for {
@@ -392,11 +986,157 @@ func (hc *HeaderChain) findCommonAncestor(header *types.Header) *types.Header {
 		if canonicalHash == header.Hash() {
 			return hc.GetHeaderByHash(canonicalHash)
 		}
+		if header.NumberU64() == 0 {
+			return nil
+		}
 		header = hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
 	}
 
 }
 
+// commonAncestor returns the most recent header shared by the branches ending
+// in a and b, or nil if either branch is missing an ancestor.
+func (hc *HeaderChain) commonAncestor(a, b *types.Header) *types.Header {
+	for a != nil && b != nil && a.Hash() != b.Hash() {
+		if a.NumberU64() == 0 && b.NumberU64() == 0 {
+			return nil
+		}
+		// Step back on the higher branch, or on both if level
+		if a.NumberU64() >= b.NumberU64() {
+			a = hc.GetHeader(a.ParentHash(), a.NumberU64()-1)
+		}
+		if b != nil && (a == nil || b.NumberU64() > a.NumberU64()) {
+			b = hc.GetHeader(b.ParentHash(), b.NumberU64()-1)
+		}
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	return a
+}
+
+// GlobalCommonAncestor returns the most recent header shared by every tracked
+// head, below which all forks agree. Fully diverged heads yield the genesis.
+func (hc *HeaderChain) GlobalCommonAncestor() (*types.Header, error) {
+	hc.headermu.RLock()
+	defer hc.headermu.RUnlock()
+
+	if len(hc.heads) == 0 {
+		return nil, errors.New("no heads tracked")
+	}
+	ancestor := hc.heads[0]
+	for _, head := range hc.heads[1:] {
+		if ancestor = hc.commonAncestor(ancestor, head); ancestor == nil {
+			return nil, fmt.Errorf("no common ancestor with head %s", head.Hash().String())
+		}
+	}
+	return ancestor, nil
+}
+
+// ForkPoints returns, for each of the tracked heads, the header at which its
+// branch diverges from the canonical chain, keyed by the hash of the head.
+func (hc *HeaderChain) ForkPoints() map[common.Hash]*types.Header {
+	hc.headermu.RLock()
+	defer hc.headermu.RUnlock()
+
+	forkPoints := make(map[common.Hash]*types.Header, len(hc.heads))
+	for _, head := range hc.heads {
+		if forkPoint := hc.findCommonAncestor(head); forkPoint != nil {
+			forkPoints[head.Hash()] = forkPoint
+		}
+	}
+	return forkPoints
+}
+
+// ForkBase returns the hash and number of the canonical header at which the
+// branch of the given tracked head diverges from the canonical chain. A head on
+// the canonical chain is its own fork base.
+func (hc *HeaderChain) ForkBase(headHash common.Hash) (common.Hash, uint64, error) {
+	hc.headermu.RLock()
+	defer hc.headermu.RUnlock()
+
+	for _, head := range hc.heads {
+		if head.Hash() != headHash {
+			continue
+		}
+		forkPoint := hc.findCommonAncestor(head)
+		if forkPoint == nil {
+			return common.Hash{}, 0, fmt.Errorf("no canonical ancestor for head %s", headHash.String())
+		}
+		return forkPoint.Hash(), forkPoint.NumberU64(), nil
+	}
+	return common.Hash{}, 0, fmt.Errorf("%s is not a tracked head", headHash.String())
+}
+
+// HeadsByEntropy returns a copy of the tracked heads sorted by descending total
+// entropy, so the first element is the best tip. Heads of equal entropy are
+// ordered by hash to keep the result deterministic.
+func (hc *HeaderChain) HeadsByEntropy() []*types.Header {
+	hc.headermu.RLock()
+	heads := make([]*types.Header, len(hc.heads))
+	copy(heads, hc.heads)
+	hc.headermu.RUnlock()
+
+	entropies := make(map[common.Hash]*big.Int, len(heads))
+	for _, head := range heads {
+		entropies[head.Hash()] = hc.engine.TotalLogS(head)
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		hashI, hashJ := heads[i].Hash(), heads[j].Hash()
+		if cmp := entropies[hashI].Cmp(entropies[hashJ]); cmp != 0 {
+			return cmp > 0
+		}
+		return bytes.Compare(hashI[:], hashJ[:]) < 0
+	})
+	return heads
+}
+
+// RecomputeHead promotes the tracked head of highest total entropy to current
+// header if it is heavier than the current one, as may be needed after a crash
+// left a lighter head persisted. It returns the resulting current header.
+func (hc *HeaderChain) RecomputeHead() (*types.Header, error) {
+	current := hc.CurrentHeader()
+	heads := hc.HeadsByEntropy()
+	if len(heads) == 0 || hc.engine.TotalLogS(heads[0]).Cmp(hc.engine.TotalLogS(current)) <= 0 {
+		return current, nil
+	}
+	if err := hc.SetCurrentHeader(heads[0]); err != nil {
+		return nil, err
+	}
+	log.Info("Promoted heaviest head", "number", heads[0].NumberU64(), "hash", heads[0].Hash(), "previous", current.Hash())
+	return heads[0], nil
+}
+
+// GetEntropies returns the total entropy of the headers of the given hashes
+// positionally, letting fork choice compare many tips in one call. Unknown
+// hashes yield a nil entropy.
+func (hc *HeaderChain) GetEntropies(hashes []common.Hash) []*big.Int {
+	entropies := make([]*big.Int, len(hashes))
+	for i, hash := range hashes {
+		if header := hc.GetHeaderByHash(hash); header != nil {
+			entropies[i] = hc.engine.TotalLogS(header)
+		}
+	}
+	return entropies
+}
+
+// GetHeaderNumbers returns the numbers of the header of the given hash in each
+// context, indexed by context. A context the header carries no number for
+// yields zero.
+func (hc *HeaderChain) GetHeaderNumbers(hash common.Hash) ([]uint64, error) {
+	header := hc.GetHeaderByHash(hash)
+	if header == nil {
+		return nil, ErrHeaderNotFound
+	}
+	numbers := make([]uint64, len(header.NumberArray()))
+	for ctx, number := range header.NumberArray() {
+		if number != nil {
+			numbers[ctx] = number.Uint64()
+		}
+	}
+	return numbers, nil
+}
+
 func (hc *HeaderChain) AddPendingEtxs(pEtxs types.PendingEtxs) error {
 	if !pEtxs.IsValid(trie.NewStackTrie(nil)) {
 		return ErrPendingEtxNotValid
@@ -436,36 +1176,117 @@ func (hc *HeaderChain) loadLastState() error {
 	if head := rawdb.ReadHeadBlockHash(hc.headerDb); head != (common.Hash{}) {
 		if chead := hc.GetHeaderByHash(head); chead != nil {
 			hc.currentHeader.Store(chead)
+			hc.warmHeaderCache(chead)
 		}
 	}
 
 	heads := make([]*types.Header, 0)
 	for _, hash := range headsHashes {
-		heads = append(heads, hc.GetHeaderByHash(hash))
+		head := hc.GetHeaderByHash(hash)
+		if head == nil {
+			log.Warn("Dropping head with missing header", "hash", hash)
+			continue
+		}
+		heads = append(heads, head)
 	}
 	hc.heads = heads
+	headsGauge.Update(int64(len(heads)))
 
 	return nil
 }
 
-// Stop stops the blockchain service. If any imports are currently in progress
-// it will abort them using the procInterrupt.
-func (hc *HeaderChain) Stop() {
-	if !atomic.CompareAndSwapInt32(&hc.running, 0, 1) {
-		return
+// HighestCanonicalNumber returns the highest number with a canonical hash in
+// the database. As canonical hashes are stored contiguously from the genesis,
+// it gallops upwards until a number is missing and then bisects the gap, instead
+// of scanning every number.
+func (hc *HeaderChain) HighestCanonicalNumber() (uint64, error) {
+	hasCanonical := func(number uint64) bool {
+		return rawdb.ReadCanonicalHash(hc.headerDb, number) != (common.Hash{})
+	}
+	if !hasCanonical(0) {
+		return 0, ErrNoCanonicalHash
+	}
+	// Find a missing number above the highest present one, lo stays present
+	lo, hi := uint64(0), uint64(1)
+	for hasCanonical(hi) {
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if hasCanonical(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
 	}
+	return lo, nil
+}
+
+// resetHeads makes the given header the current one and drops all tracked
+// heads, both in memory and in the database, so that a restart does not reload
+// heads which no longer exist. Nothing changes if the database write fails.
+func (hc *HeaderChain) resetHeads(head *types.Header) error {
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
 
-	hashes := make([]common.Hash, 0)
-	for i := 0; i < len(hc.heads); i++ {
-		hashes = append(hashes, hc.heads[i].Hash())
+	batch := hc.headerDb.NewBatch()
+	rawdb.DeleteAllHeadsHashes(batch)
+	rawdb.WriteHeadBlockHash(batch, head.Hash())
+	if err := batch.Write(); err != nil {
+		return err
 	}
-	// Save the heads
-	rawdb.WriteHeadsHashes(hc.headerDb, hashes)
-	rawdb.WriteHeadBlockHash(hc.headerDb, hc.CurrentHeader().Hash())
+	hc.currentHeader.Store(head)
+	hc.heads = make([]*types.Header, 0)
+	headsGauge.Update(0)
+	return nil
+}
 
-	// Unsubscribe all subscriptions registered from blockchain
-	hc.scope.Close()
+// warmHeaderCache loads the warmHeaders canonical headers up to the given head
+// into the header cache in the background, so that early reads after startup
+// need not hit the database. At most a cache full of headers is loaded.
+func (hc *HeaderChain) warmHeaderCache(head *types.Header) {
+	if hc.warmHeaders <= 0 {
+		return
+	}
+	count := uint64(hc.warmHeaders)
+	if count > headerCacheLimit {
+		count = headerCacheLimit
+	}
+	if count > head.NumberU64()+1 {
+		count = head.NumberU64() + 1
+	}
+	hashes := make([]common.Hash, 0, count)
+	for nr := head.NumberU64(); uint64(len(hashes)) < count; nr-- {
+		hashes = append(hashes, rawdb.ReadCanonicalHash(hc.headerDb, nr))
+	}
+	hc.PrefetchHeaders(hashes)
+}
+
+// Stop stops the blockchain service. If any imports are currently in progress
+// it will abort them using the procInterrupt.
+func (hc *HeaderChain) Stop() {
+	if !atomic.CompareAndSwapInt32(&hc.running, 0, 1) {
+		return
+	}
+
+	// Save the heads
+	if err := hc.FlushHeads(); err != nil {
+		log.Error("Failed to persist heads", "err", err)
+	}
+
+	// Unsubscribe all subscriptions registered from blockchain
+	hc.scope.Close()
 	hc.bc.scope.Close()
+
+	// Signal the background routines to exit and wait for them. A scheduled
+	// heads change event is cancelled, the timer not releasing the wait group
+	// itself if it never fires.
+	close(hc.quit)
+	hc.headermu.Lock()
+	if hc.headsChangeTimer != nil && hc.headsChangeTimer.Stop() {
+		hc.wg.Done()
+	}
+	hc.headermu.Unlock()
 	hc.wg.Wait()
 	if common.NodeLocation.Context() == common.ZONE_CTX {
 		hc.bc.processor.Stop()
@@ -473,6 +1294,31 @@ func (hc *HeaderChain) Stop() {
 	log.Info("headerchain stopped")
 }
 
+// FlushHeads persists the tracked heads together with the current head in a
+// single batch, so a crash never leaves one written without the other.
+func (hc *HeaderChain) FlushHeads() error {
+	hc.headermu.RLock()
+	hashes := make([]common.Hash, len(hc.heads))
+	for i, head := range hc.heads {
+		hashes[i] = head.Hash()
+	}
+	current := hc.CurrentHeader().Hash()
+	hc.headermu.RUnlock()
+
+	batch := hc.headerDb.NewBatch()
+	rawdb.WriteHeadsHashes(batch, hashes)
+	rawdb.WriteHeadBlockHash(batch, current)
+	return batch.Write()
+}
+
+// Ping performs a trivial read against the header database, returning any error
+// the database reports. It allows supervisors to health-check the store.
+func (hc *HeaderChain) Ping() error {
+	// Only the error matters here, the probed key need not exist
+	_, err := hc.headerDb.Has(hc.genesisHeader.Hash().Bytes())
+	return err
+}
+
 // Empty checks if the headerchain is empty.
 func (hc *HeaderChain) Empty() bool {
 	genesis := hc.config.GenesisHash
@@ -498,6 +1344,43 @@ func (hc *HeaderChain) GetBlockNumber(hash common.Hash) *uint64 {
 	return number
 }
 
+// VerifySeal checks only the proof-of-work of the given header, without any
+// parent or contiguity checks. Unlike Append, it can be used on a gossiped
+// header before its parent is known.
+func (hc *HeaderChain) VerifySeal(header *types.Header) error {
+	return hc.engine.VerifySeal(header)
+}
+
+// VerifyHeaderAgainst verifies the given header with the consensus engine
+// against the given parent, which need not be stored yet. This allows batches
+// of headers to be verified before any of them is written.
+func (hc *HeaderChain) VerifyHeaderAgainst(header, parent *types.Header) error {
+	return hc.engine.VerifyHeaderAgainst(hc, header, parent)
+}
+
+// GetBlockNumberE is like GetBlockNumber, but retries failing database reads
+// and reports them once the retries are exhausted. ErrHeaderNotFound is
+// returned if the hash is unknown.
+func (hc *HeaderChain) GetBlockNumberE(hash common.Hash) (*uint64, error) {
+	if cached, ok := hc.numberCache.Get(hash); ok {
+		number := cached.(uint64)
+		return &number, nil
+	}
+	var number *uint64
+	err := retryRead(func() (err error) {
+		number, err = rawdb.ReadHeaderNumberE(hc.headerDb, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if number == nil {
+		return nil, ErrHeaderNotFound
+	}
+	hc.numberCache.Add(hash, *number)
+	return number, nil
+}
+
 func (hc *HeaderChain) GetTerminiByHash(hash common.Hash) []common.Hash {
 	termini := rawdb.ReadTermini(hc.headerDb, hash)
 	return termini
@@ -506,6 +1389,13 @@ func (hc *HeaderChain) GetTerminiByHash(hash common.Hash) []common.Hash {
 // GetBlockHashesFromHash retrieves a number of block hashes starting at a given
 // hash, fetching towards the genesis block.
 func (hc *HeaderChain) GetBlockHashesFromHash(hash common.Hash, max uint64) []common.Hash {
+	// Short circuit if the hashes are already in the cache, parent links never
+	// change so a cached list stays valid until headers are deleted, which drops
+	// all cached lists
+	key := blockHashesKey{hash: hash, max: max}
+	if cached, ok := hc.blockHashesCache.Get(key); ok {
+		return append([]common.Hash(nil), cached.([]common.Hash)...)
+	}
 	// Get the origin header from which to fetch
 	header := hc.GetHeaderByHash(hash)
 	if header == nil {
@@ -514,18 +1404,64 @@ func (hc *HeaderChain) GetBlockHashesFromHash(hash common.Hash, max uint64) []co
 	// Iterate the headers until enough is collected or the genesis reached
 	chain := make([]common.Hash, 0, max)
 	for i := uint64(0); i < max; i++ {
+		if header.NumberU64() == 0 {
+			break
+		}
 		next := header.ParentHash()
 		if header = hc.GetHeader(next, header.NumberU64()-1); header == nil {
-			break
+			// Don't cache partial lists, the missing header may still arrive
+			return chain
 		}
 		chain = append(chain, next)
-		if header.Number().Sign() == 0 {
+	}
+	hc.blockHashesCache.Add(key, append([]common.Hash(nil), chain...))
+	return chain
+}
+
+// Children returns the stored headers, on any branch, whose parent is the
+// header of the given hash and number.
+func (hc *HeaderChain) Children(hash common.Hash, number uint64) []*types.Header {
+	var children []*types.Header
+	for _, child := range rawdb.ReadAllHashes(hc.headerDb, number+1) {
+		if header := hc.GetHeader(child, number+1); header != nil && header.ParentHash() == hash {
+			children = append(children, header)
+		}
+	}
+	return children
+}
+
+// GetBlockHashesUntil retrieves at most max ancestor hashes of start, fetching
+// towards the genesis block like GetBlockHashesFromHash, but stops early once
+// the already known stop hash is reached. The stop hash is not included.
+func (hc *HeaderChain) GetBlockHashesUntil(start, stop common.Hash, max uint64) []common.Hash {
+	header := hc.GetHeaderByHash(start)
+	if header == nil {
+		return nil
+	}
+	chain := make([]common.Hash, 0, max)
+	for i := uint64(0); i < max; i++ {
+		if header.NumberU64() == 0 {
 			break
 		}
+		next := header.ParentHash()
+		if next == stop {
+			break
+		}
+		if header = hc.GetHeader(next, header.NumberU64()-1); header == nil {
+			break
+		}
+		chain = append(chain, next)
 	}
 	return chain
 }
 
+// blockHashesKey identifies a GetBlockHashesFromHash query in the block hashes
+// cache.
+type blockHashesKey struct {
+	hash common.Hash
+	max  uint64
+}
+
 // GetAncestor retrieves the Nth ancestor of a given block. It assumes that either the given block or
 // a close ancestor of it is canonical. maxNonCanonical points to a downwards counter limiting the
 // number of blocks to be individually checked before we reach the canonical chain.
@@ -542,14 +1478,24 @@ func (hc *HeaderChain) GetAncestor(hash common.Hash, number, ancestor uint64, ma
 		}
 		return common.Hash{}, 0
 	}
+	key := ancestorKey{hash: hash, ancestor: ancestor}
 	for ancestor != 0 {
 		if rawdb.ReadCanonicalHash(hc.headerDb, number) == hash {
 			ancestorHash := rawdb.ReadCanonicalHash(hc.headerDb, number-ancestor)
 			if rawdb.ReadCanonicalHash(hc.headerDb, number) == hash {
 				number -= ancestor
+				if hash != key.hash {
+					hc.ancestorCache.Add(key, ancestorHash)
+				}
 				return ancestorHash, number
 			}
 		}
+		// The origin is not canonical, try to short circuit the walk
+		if hash == key.hash {
+			if cached, ok := hc.ancestorCache.Get(key); ok {
+				return cached.(common.Hash), number - key.ancestor
+			}
+		}
 		if *maxNonCanonical == 0 {
 			return common.Hash{}, 0
 		}
@@ -562,9 +1508,33 @@ func (hc *HeaderChain) GetAncestor(hash common.Hash, number, ancestor uint64, ma
 		hash = header.ParentHash()
 		number--
 	}
+	if hash != key.hash {
+		hc.ancestorCache.Add(key, hash)
+	}
 	return hash, number
 }
 
+// GetAncestorHeader retrieves the header of the Nth ancestor of a given block,
+// walking at most ancestorMaxNonCanon non-canonical blocks to find it.
+func (hc *HeaderChain) GetAncestorHeader(hash common.Hash, number, ancestor uint64) (*types.Header, error) {
+	maxNonCanonical := uint64(ancestorMaxNonCanon)
+	ancestorHash, ancestorNumber := hc.GetAncestor(hash, number, ancestor, &maxNonCanonical)
+	if ancestorHash == (common.Hash{}) {
+		return nil, fmt.Errorf("ancestor %d of #%d [%s] not found", ancestor, number, hash.String())
+	}
+	header := hc.GetHeader(ancestorHash, ancestorNumber)
+	if header == nil {
+		return nil, fmt.Errorf("ancestor header #%d [%s] not found", ancestorNumber, ancestorHash.String())
+	}
+	return header, nil
+}
+
+// ancestorKey identifies a GetAncestor query in the ancestor cache.
+type ancestorKey struct {
+	hash     common.Hash
+	ancestor uint64
+}
+
 func (hc *HeaderChain) WriteBlock(block *types.Block) {
 	hc.bc.WriteBlock(block)
 }
@@ -576,9 +1546,13 @@ func (hc *HeaderChain) GetHeader(hash common.Hash, number uint64) *types.Header
 	if termini == nil {
 		return nil
 	}
+	// Most appends extend the current header, so it is the most looked up parent
+	if hc.isCurrentHeader(hash, number) {
+		return hc.CurrentHeader()
+	}
 	// Short circuit if the header's already in the cache, retrieve otherwise
-	if header, ok := hc.headerCache.Get(hash); ok {
-		return header.(*types.Header)
+	if header := hc.cachedHeader(hash, number); header != nil {
+		return header
 	}
 	header := rawdb.ReadHeader(hc.headerDb, hash, number)
 	if header == nil {
@@ -589,6 +1563,88 @@ func (hc *HeaderChain) GetHeader(hash common.Hash, number uint64) *types.Header
 	return header
 }
 
+// GetHeaderE is like GetHeader, but retries failing database reads and reports
+// them once the retries are exhausted, rather than passing them off as a
+// missing header. ErrHeaderNotFound is returned if the header is unknown.
+func (hc *HeaderChain) GetHeaderE(hash common.Hash, number uint64) (*types.Header, error) {
+	var termini []common.Hash
+	err := retryRead(func() (err error) {
+		termini, err = rawdb.ReadTerminiE(hc.headerDb, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if termini == nil {
+		return nil, ErrHeaderNotFound
+	}
+	if header := hc.cachedHeader(hash, number); header != nil {
+		return header, nil
+	}
+	var header *types.Header
+	err = retryRead(func() (err error) {
+		header, err = rawdb.ReadHeaderE(hc.headerDb, hash, number)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, ErrHeaderNotFound
+	}
+	hc.headerCache.Add(hash, header)
+	return header, nil
+}
+
+// isCurrentHeader reports whether the given hash and number identify the
+// current header. It is safe to call before the current header is first set.
+func (hc *HeaderChain) isCurrentHeader(hash common.Hash, number uint64) bool {
+	current, ok := hc.currentHeader.Load().(*types.Header)
+	return ok && current.Hash() == hash && current.NumberU64() == number
+}
+
+// cachedHeader returns the header cached under hash, or nil if there is none.
+// In strict mode, a cached header not at the given number is evicted instead.
+func (hc *HeaderChain) cachedHeader(hash common.Hash, number uint64) *types.Header {
+	header, ok := hc.headerCache.Get(hash)
+	if !ok {
+		return nil
+	}
+	cached := header.(*types.Header)
+	if atomic.LoadInt32(&hc.strictHeaderCache) == 0 || cached.NumberU64() == number {
+		return cached
+	}
+	log.Warn("Evicting cached header with mismatched number", "hash", hash, "cached", cached.NumberU64(), "requested", number)
+	hc.headerCache.Remove(hash)
+	return nil
+}
+
+// retryRead runs read until it succeeds, giving up with its last error after
+// dbReadRetries attempts.
+func retryRead(read func() error) error {
+	var err error
+	for i := 0; i < dbReadRetries; i++ {
+		if i > 0 {
+			time.Sleep(dbReadRetryDelay)
+		}
+		if err = read(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// SetStrictHeaderCache toggles cross-checking the number of cached headers in
+// GetHeader against the requested one. Mismatching entries are evicted and the
+// header is read from the database instead.
+func (hc *HeaderChain) SetStrictHeaderCache(strict bool) {
+	if strict {
+		atomic.StoreInt32(&hc.strictHeaderCache, 1)
+	} else {
+		atomic.StoreInt32(&hc.strictHeaderCache, 0)
+	}
+}
+
 // GetHeaderByHash retrieves a block header from the database by hash, caching it if
 // found.
 func (hc *HeaderChain) GetHeaderByHash(hash common.Hash) *types.Header {
@@ -604,6 +1660,79 @@ func (hc *HeaderChain) GetHeaderByHash(hash common.Hash) *types.Header {
 	return hc.GetHeader(hash, *number)
 }
 
+// SafeGetHeaderByHash retrieves a block header like GetHeaderByHash, but turns
+// any panic raised by corrupt data on the read path into ErrCorruptHeader. It
+// is meant for paths serving untrusted input, such as the RPC API.
+func (hc *HeaderChain) SafeGetHeaderByHash(hash common.Hash) (h *types.Header, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Recovered from reading corrupt header", "hash", hash, "err", r)
+			h, err = nil, ErrCorruptHeader
+		}
+	}()
+	return hc.GetHeaderByHash(hash), nil
+}
+
+// StreamHeaders resolves the headers of the given hashes in order and emits them
+// over the returned channel, which is closed once all hashes are processed or
+// the header chain is stopped. Unknown hashes are skipped.
+func (hc *HeaderChain) StreamHeaders(hashes []common.Hash) <-chan *types.Header {
+	headers := make(chan *types.Header)
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+		defer close(headers)
+		for _, hash := range hashes {
+			if header := hc.GetHeaderByHash(hash); header != nil {
+				select {
+				case headers <- header:
+				case <-hc.quit:
+					return
+				}
+			}
+		}
+	}()
+	return headers
+}
+
+// PrefetchHeaders asynchronously loads the headers of the given hashes into the
+// header cache using a bounded pool of workers. The returned channel is closed
+// once all hashes are processed or the header chain is stopped. Unknown hashes
+// are skipped.
+func (hc *HeaderChain) PrefetchHeaders(hashes []common.Hash) <-chan struct{} {
+	var (
+		tasks = make(chan common.Hash)
+		done  = make(chan struct{})
+		wg    sync.WaitGroup
+	)
+	hc.wg.Add(prefetchWorkers + 1)
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer hc.wg.Done()
+			defer wg.Done()
+			for hash := range tasks {
+				hc.GetHeaderByHash(hash)
+			}
+		}()
+	}
+	go func() {
+		defer hc.wg.Done()
+	dispatch:
+		for _, hash := range hashes {
+			select {
+			case tasks <- hash:
+			case <-hc.quit:
+				break dispatch
+			}
+		}
+		close(tasks)
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
 // GetHeaderOrCandidate retrieves a block header from the database by hash and number,
 // caching it if found.
 func (hc *HeaderChain) GetHeaderOrCandidate(hash common.Hash, number uint64) *types.Header {
@@ -635,7 +1764,7 @@ func (hc *HeaderChain) GetHeaderOrCandidateByHash(hash common.Hash) *types.Heade
 // In theory, if header is present in the database, all relative components
 // like td and hash->number should be present too.
 func (hc *HeaderChain) HasHeader(hash common.Hash, number uint64) bool {
-	if hc.numberCache.Contains(hash) || hc.headerCache.Contains(hash) {
+	if hc.isCurrentHeader(hash, number) || hc.numberCache.Contains(hash) || hc.headerCache.Contains(hash) {
 		return true
 	}
 	return rawdb.HasHeader(hc.headerDb, hash, number)
@@ -651,22 +1780,272 @@ func (hc *HeaderChain) GetHeaderByNumber(number uint64) *types.Header {
 	return hc.GetHeader(hash, number)
 }
 
+// GetHeaderByNumberOnBranch retrieves the header at the given number along the
+// branch ending in tip, which need not be canonical, by following parent links
+// back from the tip.
+func (hc *HeaderChain) GetHeaderByNumberOnBranch(tip common.Hash, number uint64) (*types.Header, error) {
+	header := hc.GetHeaderByHash(tip)
+	if header == nil {
+		return nil, fmt.Errorf("branch tip %s not found", tip.String())
+	}
+	if number > header.NumberU64() {
+		return nil, fmt.Errorf("number %d is above branch tip #%d", number, header.NumberU64())
+	}
+	for header.NumberU64() > number {
+		parent := hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
+		if parent == nil {
+			return nil, fmt.Errorf("branch ends at #%d before reaching #%d", header.NumberU64(), number)
+		}
+		header = parent
+	}
+	return header, nil
+}
+
+// BranchLength returns the length of the branch ending in tip, verifying that
+// every ancestor down to the genesis is actually present instead of trusting
+// the number the tip claims.
+func (hc *HeaderChain) BranchLength(tip common.Hash) (uint64, error) {
+	header := hc.GetHeaderByHash(tip)
+	if header == nil {
+		return 0, fmt.Errorf("branch tip %s not found", tip.String())
+	}
+	length := header.NumberU64()
+	for header.NumberU64() > 0 {
+		parent := hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
+		if parent == nil {
+			return 0, fmt.Errorf("branch broken at #%d: parent %s not found", header.NumberU64(), header.ParentHash().String())
+		}
+		header = parent
+	}
+	if header.Hash() != hc.config.GenesisHash {
+		return 0, fmt.Errorf("branch does not lead to genesis: %s", header.Hash().String())
+	}
+	return length, nil
+}
+
+// CanonicalDigest returns the keccak256 hash of the concatenated canonical
+// hashes numbered from first to last inclusive, a fingerprint nodes can compare
+// to cheaply detect their canonical chains diverging within the range.
+func (hc *HeaderChain) CanonicalDigest(first, last uint64) (common.Hash, error) {
+	if first > last {
+		return common.Hash{}, fmt.Errorf("digest failed: first (%d) is greater than last (%d)", first, last)
+	}
+	hasher := crypto.NewKeccakState()
+	for nr := first; nr <= last; nr++ {
+		hash := rawdb.ReadCanonicalHash(hc.headerDb, nr)
+		if hash == (common.Hash{}) {
+			return common.Hash{}, fmt.Errorf("digest failed on #%d: %w", nr, ErrNoCanonicalHash)
+		}
+		hasher.Write(hash[:])
+	}
+	var digest common.Hash
+	hasher.Read(digest[:])
+	return digest, nil
+}
+
+// GetHeaderFromDB retrieves a block header from the database by hash and
+// number, neither consulting nor populating the header cache. It is meant for
+// integrity checks, which must not be misled by stale cache entries.
+func (hc *HeaderChain) GetHeaderFromDB(hash common.Hash, number uint64) *types.Header {
+	return rawdb.ReadHeader(hc.headerDb, hash, number)
+}
+
+// VerifyCanonicalChain checks that every canonical header in the [from, to]
+// range links to the canonical header one number below it, returning an error
+// identifying the first break.
+func (hc *HeaderChain) VerifyCanonicalChain(from, to uint64) error {
+	if from > to {
+		return fmt.Errorf("verify failed: from (%d) is greater than to (%d)", from, to)
+	}
+	for nr := from; nr <= to; nr++ {
+		// Audit what is stored, not what may linger in the caches
+		header := hc.GetHeaderFromDB(rawdb.ReadCanonicalHash(hc.headerDb, nr), nr)
+		if header == nil {
+			return fmt.Errorf("canonical chain broken at #%d: header not found", nr)
+		}
+		if nr == 0 {
+			continue
+		}
+		if parent := rawdb.ReadCanonicalHash(hc.headerDb, nr-1); header.ParentHash() != parent {
+			return fmt.Errorf("canonical chain broken at #%d: parent %s, canonical #%d %s", nr, header.ParentHash().String(), nr-1, parent.String())
+		}
+	}
+	return nil
+}
+
+// GetHeadersByNumberRange retrieves the canonical headers numbered first to last
+// inclusive, in ascending order or, if reverse is set, in descending order as
+// the networking protocol's reverse header requests expect. Ranges reaching past
+// the current head end at it. Retrieval stops at the first missing header.
+func (hc *HeaderChain) GetHeadersByNumberRange(first, last uint64, reverse bool) []*types.Header {
+	// The range comes from callers and peers, so clamp it to the current head,
+	// past which no canonical headers exist, before allocating for it
+	if head := hc.CurrentHeader().NumberU64(); last > head {
+		last = head
+	}
+	if first > last {
+		return nil
+	}
+	headers := make([]*types.Header, 0, last-first+1)
+	if !reverse {
+		for nr := first; nr <= last; nr++ {
+			header := hc.GetHeaderByNumber(nr)
+			if header == nil {
+				break
+			}
+			headers = append(headers, header)
+		}
+		return headers
+	}
+	for nr := last; ; nr-- {
+		header := hc.GetHeaderByNumber(nr)
+		if header == nil {
+			break
+		}
+		headers = append(headers, header)
+		// Stop at the start of the range, never walking past the genesis
+		if nr == first || nr == 0 {
+			break
+		}
+	}
+	return headers
+}
+
+// HeaderByNumber retrieves the canonical header at the given number like
+// GetHeaderByNumber, but tells a number without canonical block apart from a
+// canonical hash whose header is missing from the database.
+func (hc *HeaderChain) HeaderByNumber(number uint64) (*types.Header, error) {
+	hash := rawdb.ReadCanonicalHash(hc.headerDb, number)
+	if hash == (common.Hash{}) {
+		return nil, ErrNoCanonicalHash
+	}
+	header := hc.GetHeader(hash, number)
+	if header == nil {
+		return nil, ErrHeaderNotFound
+	}
+	return header, nil
+}
+
+// CanonicalCursor iterates the canonical headers upwards from a start number
+// until the current head, retrieving each header only when asked for.
+type CanonicalCursor struct {
+	hc   *HeaderChain
+	next uint64 // Number of the header returned by the next call to Next
+}
+
+// NewCanonicalCursor creates a cursor over the canonical chain starting at the
+// given number.
+func (hc *HeaderChain) NewCanonicalCursor(start uint64) *CanonicalCursor {
+	return &CanonicalCursor{hc: hc, next: start}
+}
+
+// Next returns the next canonical header and advances the cursor. It reports
+// false once the cursor moves past the current head or reaches a missing header.
+func (c *CanonicalCursor) Next() (*types.Header, bool) {
+	if c.next > c.hc.CurrentHeader().NumberU64() {
+		return nil, false
+	}
+	header := c.hc.GetHeaderByNumber(c.next)
+	if header == nil {
+		return nil, false
+	}
+	c.next++
+	return header, true
+}
+
 func (hc *HeaderChain) GetCanonicalHash(number uint64) common.Hash {
 	hash := rawdb.ReadCanonicalHash(hc.headerDb, number)
 	return hash
 }
 
+// ForceCanonical marks the known block of the given hash as canonical at its
+// number, for operators recovering a node. If the number is that of the current
+// head, the block also becomes the current head.
+func (hc *HeaderChain) ForceCanonical(hash common.Hash, number uint64) error {
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
+
+	header := hc.GetHeaderByHash(hash)
+	if header == nil {
+		return fmt.Errorf("header %s not found", hash.String())
+	}
+	if header.NumberU64() != number {
+		return fmt.Errorf("header %s is #%d, not #%d", hash.String(), header.NumberU64(), number)
+	}
+	rawdb.WriteCanonicalHash(hc.headerDb, hash, number)
+
+	// Ancestors and blocks resolved through the old canonical chain may be stale
+	hc.ancestorCache.Purge()
+	hc.canonicalBlocks.Remove(number)
+
+	if hc.CurrentHeader().NumberU64() == number {
+		rawdb.WriteHeadBlockHash(hc.headerDb, hash)
+		hc.currentHeader.Store(header)
+	}
+	return nil
+}
+
+// IsCanonical reports whether the block of the given hash and number is part of
+// the canonical chain, without loading its header.
+func (hc *HeaderChain) IsCanonical(hash common.Hash, number uint64) bool {
+	return rawdb.ReadCanonicalHash(hc.headerDb, number) == hash
+}
+
 // CurrentHeader retrieves the current head header of the canonical chain. The
 // header is retrieved from the HeaderChain's internal cache.
 func (hc *HeaderChain) CurrentHeader() *types.Header {
 	return hc.currentHeader.Load().(*types.Header)
 }
 
+// HeadAge returns how long ago the current head was mined according to its
+// timestamp, letting monitoring detect a stalled chain. Heads from the future,
+// due to clock skew, are reported with a zero age.
+func (hc *HeaderChain) HeadAge() time.Duration {
+	age := time.Since(time.Unix(int64(hc.CurrentHeader().Time()), 0))
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// RecentHeaders returns up to n canonical headers ending at the current head,
+// in ascending order, by walking back along the parent links of the head.
+func (hc *HeaderChain) RecentHeaders(n int) []*types.Header {
+	if n <= 0 {
+		return []*types.Header{}
+	}
+	// No more headers than the head and its ancestors can be returned, however
+	// many are asked for
+	head := hc.CurrentHeader()
+	if max := head.NumberU64() + 1; uint64(n) > max {
+		n = int(max)
+	}
+	headers := make([]*types.Header, 0, n)
+	for header := head; header != nil && len(headers) < n; {
+		headers = append(headers, header)
+		if header.NumberU64() == 0 {
+			break
+		}
+		header = hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
+	}
+	// Reverse the walk to ascending order
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	return headers
+}
+
 // CurrentBlock returns the block for the current header.
 func (hc *HeaderChain) CurrentBlock() *types.Block {
 	return hc.GetBlockByHash(hc.CurrentHeader().Hash())
 }
 
+// CacheStats returns the number of entries held in the header, number and
+// ancestor caches.
+func (hc *HeaderChain) CacheStats() (headerLen, numberLen, ancestorLen int) {
+	return hc.headerCache.Len(), hc.numberCache.Len(), hc.ancestorCache.Len()
+}
+
 // SetGenesis sets a new genesis block header for the chain
 func (hc *HeaderChain) SetGenesis(head *types.Header) {
 	hc.genesisHeader = head
@@ -691,10 +2070,13 @@ func (hc *HeaderChain) CheckContext(context int) error {
 
 // CheckLocationRange checks to make sure the range of r and z are valid
 func (hc *HeaderChain) CheckLocationRange(location []byte) error {
-	if int(location[0]) < 1 || int(location[0]) > common.NumRegionsInPrime {
+	if len(location) < common.HierarchyDepth-1 {
+		return errors.New("the provided location does not specify both a region and a zone")
+	}
+	if int(location[0]) >= common.NumRegionsInPrime {
 		return errors.New("the provided location is outside the allowable region range")
 	}
-	if int(location[1]) < 1 || int(location[1]) > common.NumZonesInRegion {
+	if int(location[1]) >= common.NumZonesInRegion {
 		return errors.New("the provided location is outside the allowable zone range")
 	}
 	return nil
@@ -711,6 +2093,9 @@ func (hc *HeaderChain) GetUnclesInChain(block *types.Block, length int) []*types
 	uncles := []*types.Header{}
 	for i := 0; block != nil && i < length; i++ {
 		uncles = append(uncles, block.Uncles()...)
+		if block.NumberU64() == 0 {
+			break
+		}
 		block = hc.GetBlock(block.ParentHash(), block.NumberU64()-1)
 	}
 	return uncles
@@ -722,17 +2107,47 @@ func (hc *HeaderChain) GetGasUsedInChain(block *types.Block, length int) int64 {
 	gasUsed := 0
 	for i := 0; block != nil && i < length; i++ {
 		gasUsed += int(block.GasUsed())
+		if block.NumberU64() == 0 {
+			break
+		}
 		block = hc.GetBlock(block.ParentHash(), block.NumberU64()-1)
 	}
 	return int64(gasUsed)
 }
 
+// GetGasUsedInChainByHeader retrieves all the gas used from a given header
+// backwards until a specific distance is reached. Unlike GetGasUsedInChain it
+// only walks headers, without loading any block bodies.
+func (hc *HeaderChain) GetGasUsedInChainByHeader(header *types.Header, length int) int64 {
+	gasUsed := uint64(0)
+	for i := 0; header != nil && i < length; i++ {
+		gasUsed += header.GasUsed()
+		if header.NumberU64() == 0 {
+			break
+		}
+		header = hc.GetHeader(header.ParentHash(), header.NumberU64()-1)
+	}
+	return int64(gasUsed)
+}
+
 // GetGasUsedInChain retrieves all the gas used from a given block backwards until
 // a specific distance is reached.
 func (hc *HeaderChain) CalculateBaseFee(header *types.Header) *big.Int {
 	return misc.CalcBaseFee(hc.Config(), header)
 }
 
+// NextBaseFee returns the base fee a child of the current head would carry.
+func (hc *HeaderChain) NextBaseFee() (*big.Int, error) {
+	head := hc.CurrentHeader()
+	if head.BaseFee() == nil {
+		return nil, fmt.Errorf("head #%d has no base fee", head.NumberU64())
+	}
+	if head.GasLimit()/params.ElasticityMultiplier == 0 {
+		return nil, fmt.Errorf("head #%d has no gas target", head.NumberU64())
+	}
+	return hc.CalculateBaseFee(head), nil
+}
+
 // Export writes the active chain to the given writer.
 func (hc *HeaderChain) Export(w io.Writer) error {
 	return hc.ExportN(w, uint64(0), hc.CurrentHeader().NumberU64())
@@ -740,6 +2155,24 @@ func (hc *HeaderChain) Export(w io.Writer) error {
 
 // ExportN writes a subset of the active chain to the given writer.
 func (hc *HeaderChain) ExportN(w io.Writer, first uint64, last uint64) error {
+	return hc.ExportWithContext(context.Background(), w, first, last)
+}
+
+// ExportWithContext writes a subset of the active chain to the given writer,
+// aborting between blocks once the context is cancelled.
+func (hc *HeaderChain) ExportWithContext(ctx context.Context, w io.Writer, first uint64, last uint64) error {
+	return hc.export(ctx, w, first, last, false)
+}
+
+// ExportHeadersN writes the headers of a subset of the active chain to the
+// given writer, leaving out the block bodies for a compact header archive.
+func (hc *HeaderChain) ExportHeadersN(w io.Writer, first uint64, last uint64) error {
+	return hc.export(context.Background(), w, first, last, true)
+}
+
+// export RLP encodes the blocks of a subset of the active chain, or only their
+// headers if headersOnly is set, into the given writer.
+func (hc *HeaderChain) export(ctx context.Context, w io.Writer, first uint64, last uint64, headersOnly bool) error {
 	hc.headermu.RLock()
 	defer hc.headermu.RUnlock()
 
@@ -750,21 +2183,121 @@ func (hc *HeaderChain) ExportN(w io.Writer, first uint64, last uint64) error {
 
 	start, reported := time.Now(), time.Now()
 	for nr := first; nr <= last; nr++ {
-		block := hc.GetBlockByNumber(nr)
-		if block == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var item interface{}
+		if headersOnly {
+			if header := hc.GetHeaderByNumber(nr); header != nil {
+				item = header
+			}
+		} else if block := hc.GetBlockByNumber(nr); block != nil {
+			item = block
+		}
+		if item == nil {
 			return fmt.Errorf("export failed on #%d: not found", nr)
 		}
-		if err := block.EncodeRLP(w); err != nil {
+		if err := rlp.Encode(w, item); err != nil {
 			return err
 		}
-		if time.Since(reported) >= statsReportLimit {
-			log.Info("Exporting blocks", "exported", block.NumberU64()-first, "elapsed", common.PrettyDuration(time.Since(start)))
+		if hc.exportReportInterval > 0 && time.Since(reported) >= hc.exportReportInterval {
+			log.Info("Exporting blocks", "exported", nr-first, "elapsed", common.PrettyDuration(time.Since(start)))
 			reported = time.Now()
 		}
 	}
 	return nil
 }
 
+// ExportJSON writes the headers of a subset of the active chain to the given
+// writer as a JSON array, encoding each header as the RPC API does.
+func (hc *HeaderChain) ExportJSON(w io.Writer, first uint64, last uint64) error {
+	hc.headermu.RLock()
+	defer hc.headermu.RUnlock()
+
+	if first > last {
+		return fmt.Errorf("export failed: first (%d) is greater than last (%d)", first, last)
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for nr := first; nr <= last; nr++ {
+		header := hc.GetHeaderByNumber(nr)
+		if header == nil {
+			return fmt.Errorf("export failed on #%d: not found", nr)
+		}
+		if nr > first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(header.RPCMarshalHeader()); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// forkTree is the JSON representation of the current fork structure written by
+// ExportForkTree.
+type forkTree struct {
+	Canonical []forkTreeNode `json:"canonical"` // Canonical chain from the lowest fork point up to the current head
+	Heads     []forkTreeHead `json:"heads"`
+}
+
+type forkTreeNode struct {
+	Hash   common.Hash `json:"hash"`
+	Number uint64      `json:"number"`
+}
+
+type forkTreeHead struct {
+	forkTreeNode
+	ForkPoint forkTreeNode `json:"forkPoint"` // Canonical header the branch of the head diverges from
+}
+
+// ExportForkTree writes the tracked heads, the canonical headers their branches
+// diverge from and the canonical chain above the lowest of those to the given
+// writer as JSON, for operators to render the current fork structure.
+func (hc *HeaderChain) ExportForkTree(w io.Writer) error {
+	hc.headermu.RLock()
+	defer hc.headermu.RUnlock()
+
+	current := hc.CurrentHeader()
+	tree := forkTree{Heads: make([]forkTreeHead, 0, len(hc.heads))}
+	lowest := current.NumberU64()
+	for _, head := range hc.heads {
+		forkPoint := hc.findCommonAncestor(head)
+		if forkPoint == nil {
+			return fmt.Errorf("no canonical ancestor for head %s", head.Hash().String())
+		}
+		tree.Heads = append(tree.Heads, forkTreeHead{
+			forkTreeNode: forkTreeNode{Hash: head.Hash(), Number: head.NumberU64()},
+			ForkPoint:    forkTreeNode{Hash: forkPoint.Hash(), Number: forkPoint.NumberU64()},
+		})
+		if forkPoint.NumberU64() < lowest {
+			lowest = forkPoint.NumberU64()
+		}
+	}
+	for nr := lowest; nr <= current.NumberU64(); nr++ {
+		hash := rawdb.ReadCanonicalHash(hc.headerDb, nr)
+		if hash == (common.Hash{}) {
+			return fmt.Errorf("export failed on #%d: %w", nr, ErrNoCanonicalHash)
+		}
+		tree.Canonical = append(tree.Canonical, forkTreeNode{Hash: hash, Number: nr})
+	}
+	return json.NewEncoder(w).Encode(tree)
+}
+
+// SetExportReportInterval sets the interval between progress logs emitted while
+// exporting the chain. A zero interval disables progress reporting.
+func (hc *HeaderChain) SetExportReportInterval(interval time.Duration) {
+	hc.headermu.Lock()
+	defer hc.headermu.Unlock()
+
+	hc.exportReportInterval = interval
+}
+
 // GetBlockFromCacheOrDb looks up the body cache first and then checks the db
 func (hc *HeaderChain) GetBlockFromCacheOrDb(hash common.Hash, number uint64) *types.Block {
 	// Short circuit if the block's already in the cache, retrieve otherwise
@@ -777,6 +2310,10 @@ func (hc *HeaderChain) GetBlockFromCacheOrDb(hash common.Hash, number uint64) *t
 
 // GetBlockByHash retrieves a block from the database by hash, caching it if found.
 func (hc *HeaderChain) GetBlockByHash(hash common.Hash) *types.Block {
+	// Short circuit the number lookup if the header's already in the cache
+	if header, ok := hc.headerCache.Get(hash); ok {
+		return hc.GetBlock(hash, header.(*types.Header).NumberU64())
+	}
 	number := hc.GetBlockNumber(hash)
 	if number == nil {
 		return nil
@@ -784,6 +2321,21 @@ func (hc *HeaderChain) GetBlockByHash(hash common.Hash) *types.Block {
 	return hc.GetBlock(hash, *number)
 }
 
+// GetBlockAndReceipts retrieves the block of the given hash along with its
+// receipts, resolving the block number only once. The receipts are nil if none
+// are stored for the block.
+func (hc *HeaderChain) GetBlockAndReceipts(hash common.Hash) (*types.Block, types.Receipts, error) {
+	number := hc.GetBlockNumber(hash)
+	if number == nil {
+		return nil, nil, fmt.Errorf("block %s not found", hash.String())
+	}
+	block := hc.GetBlock(hash, *number)
+	if block == nil {
+		return nil, nil, fmt.Errorf("block %s not found", hash.String())
+	}
+	return block, rawdb.ReadReceipts(hc.headerDb, hash, *number, hc.config), nil
+}
+
 // GetBlockOrCandidateByHash retrieves any block from the database by hash, caching it if found.
 func (hc *HeaderChain) GetBlockOrCandidateByHash(hash common.Hash) *types.Block {
 	number := hc.GetBlockNumber(hash)
@@ -796,11 +2348,43 @@ func (hc *HeaderChain) GetBlockOrCandidateByHash(hash common.Hash) *types.Block
 // GetBlockByNumber retrieves a block from the database by number, caching it
 // (associated with its hash) if found.
 func (hc *HeaderChain) GetBlockByNumber(number uint64) *types.Block {
+	// Short circuit if the block's already in the cache, retrieve otherwise
+	if cached, ok := hc.canonicalBlocks.Get(number); ok {
+		return cached.(*types.Block)
+	}
 	hash := rawdb.ReadCanonicalHash(hc.headerDb, number)
 	if hash == (common.Hash{}) {
 		return nil
 	}
-	return hc.GetBlock(hash, number)
+	block := hc.GetBlock(hash, number)
+	if block == nil {
+		return nil
+	}
+	// Cache the found block for next time and return
+	hc.canonicalBlocks.Add(number, block)
+	return block
+}
+
+// BlockByNumber retrieves the canonical block at the given number like
+// GetBlockByNumber, but tells a number without canonical block apart from a
+// canonical block whose header or body is missing from the database.
+func (hc *HeaderChain) BlockByNumber(number uint64) (*types.Block, error) {
+	if cached, ok := hc.canonicalBlocks.Get(number); ok {
+		return cached.(*types.Block), nil
+	}
+	hash := rawdb.ReadCanonicalHash(hc.headerDb, number)
+	if hash == (common.Hash{}) {
+		return nil, ErrNoCanonicalHash
+	}
+	if hc.GetHeader(hash, number) == nil {
+		return nil, ErrHeaderNotFound
+	}
+	block := hc.GetBlock(hash, number)
+	if block == nil {
+		return nil, ErrBodyNotFound
+	}
+	hc.canonicalBlocks.Add(number, block)
+	return block, nil
 }
 
 // GetBody retrieves a block body (transactions and uncles) from the database by
@@ -808,9 +2392,11 @@ func (hc *HeaderChain) GetBlockByNumber(number uint64) *types.Block {
 func (hc *HeaderChain) GetBody(hash common.Hash) *types.Body {
 	// Short circuit if the body's already in the cache, retrieve otherwise
 	if cached, ok := hc.bc.bodyCache.Get(hash); ok {
+		bodyCacheHitMeter.Mark(1)
 		body := cached.(*types.Body)
 		return body
 	}
+	bodyCacheMissMeter.Mark(1)
 	number := hc.GetBlockNumber(hash)
 	if number == nil {
 		return nil
@@ -824,26 +2410,78 @@ func (hc *HeaderChain) GetBody(hash common.Hash) *types.Body {
 	return body
 }
 
+// GetBodyWithNumber retrieves a block body like GetBody, but reads it at the
+// given number instead of resolving the number through the number cache, for
+// callers which already know it, such as those serving side branches.
+func (hc *HeaderChain) GetBodyWithNumber(hash common.Hash, number uint64) *types.Body {
+	if cached, ok := hc.bc.bodyCache.Get(hash); ok {
+		bodyCacheHitMeter.Mark(1)
+		return cached.(*types.Body)
+	}
+	bodyCacheMissMeter.Mark(1)
+	body := rawdb.ReadBody(hc.headerDb, hash, number)
+	if body == nil {
+		return nil
+	}
+	hc.bc.bodyCache.Add(hash, body)
+	return body
+}
+
 // GetBodyRLP retrieves a block body in RLP encoding from the database by hash,
 // caching it if found.
 func (hc *HeaderChain) GetBodyRLP(hash common.Hash) rlp.RawValue {
 	// Short circuit if the body's already in the cache, retrieve otherwise
 	if cached, ok := hc.bc.bodyRLPCache.Get(hash); ok {
+		bodyCacheHitMeter.Mark(1)
 		return cached.(rlp.RawValue)
 	}
+	bodyCacheMissMeter.Mark(1)
 	number := hc.GetBlockNumber(hash)
 	if number == nil {
 		return nil
 	}
 	body := rawdb.ReadBodyRLP(hc.headerDb, hash, *number)
 	if len(body) == 0 {
-		return nil
+		// The block may still be known without its raw body, in which case the
+		// body is encoded from it instead
+		block := hc.GetBlock(hash, *number)
+		if block == nil {
+			return nil
+		}
+		enc, err := rlp.EncodeToBytes(block.Body())
+		if err != nil {
+			log.Error("Failed to RLP encode body", "hash", hash, "err", err)
+			return nil
+		}
+		body = enc
 	}
 	// Cache the found body for next time and return
 	hc.bc.bodyRLPCache.Add(hash, body)
 	return body
 }
 
+// GetBodyRLPReader returns a reader over the RLP encoded body of the block of
+// the given hash, retrieved like GetBodyRLP, for serving bodies without copying
+// them.
+func (hc *HeaderChain) GetBodyRLPReader(hash common.Hash) (io.Reader, error) {
+	body := hc.GetBodyRLP(hash)
+	if body == nil {
+		return nil, ErrBodyNotFound
+	}
+	return bytes.NewReader(body), nil
+}
+
+// GetReceiptsRLP retrieves the receipts of the block of the given hash in their
+// stored RLP encoding, for proxying them without decoding. It returns nil for
+// unknown hashes.
+func (hc *HeaderChain) GetReceiptsRLP(hash common.Hash) rlp.RawValue {
+	number := hc.GetBlockNumber(hash)
+	if number == nil {
+		return nil
+	}
+	return rawdb.ReadReceiptsRLP(hc.headerDb, hash, *number)
+}
+
 // GetBlocksFromHash returns the block corresponding to hash and up to n-1 ancestors.
 // [deprecated by eth/62]
 func (hc *HeaderChain) GetBlocksFromHash(hash common.Hash, n int) (blocks []*types.Block) {
@@ -857,6 +2495,9 @@ func (hc *HeaderChain) GetBlocksFromHash(hash common.Hash, n int) (blocks []*typ
 			break
 		}
 		blocks = append(blocks, block)
+		if *number == 0 {
+			break
+		}
 		hash = block.ParentHash()
 		*number--
 	}
@@ -878,6 +2519,21 @@ func (hc *HeaderChain) SubscribeChainSideEvent(ch chan<- ChainSideEvent) event.S
 	return hc.scope.Track(hc.chainSideFeed.Subscribe(ch))
 }
 
+// SubscribeReorgEvent registers a subscription of ReorgEvent.
+func (hc *HeaderChain) SubscribeReorgEvent(ch chan<- ReorgEvent) event.Subscription {
+	return hc.scope.Track(hc.reorgFeed.Subscribe(ch))
+}
+
+// SubscribeNewHeadEvent registers a subscription of NewHeadEvent.
+func (hc *HeaderChain) SubscribeNewHeadEvent(ch chan<- NewHeadEvent) event.Subscription {
+	return hc.scope.Track(hc.newHeadFeed.Subscribe(ch))
+}
+
+// SubscribeHeadsChangeEvent registers a subscription of HeadsChangeEvent.
+func (hc *HeaderChain) SubscribeHeadsChangeEvent(ch chan<- HeadsChangeEvent) event.Subscription {
+	return hc.scope.Track(hc.headsChangeFeed.Subscribe(ch))
+}
+
 func (hc *HeaderChain) SubscribeMissingPendingEtxsEvent(ch chan<- types.HashAndLocation) event.Subscription {
 	return hc.scope.Track(hc.missingPendingEtxsFeed.Subscribe(ch))
 }
@@ -0,0 +1,2927 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/hexutil"
+	"github.com/dominant-strategies/go-quai/consensus"
+	"github.com/dominant-strategies/go-quai/consensus/misc"
+	"github.com/dominant-strategies/go-quai/core/rawdb"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/core/vm"
+	"github.com/dominant-strategies/go-quai/ethdb"
+	"github.com/dominant-strategies/go-quai/event"
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/metrics"
+	"github.com/dominant-strategies/go-quai/params"
+	"github.com/dominant-strategies/go-quai/rlp"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// newTestHeaderChain creates a header chain on top of an in-memory database
+// holding nothing but a genesis header.
+func newTestHeaderChain(t *testing.T) *HeaderChain {
+	t.Helper()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := types.EmptyHeader()
+	rawdb.WriteBlock(db, types.NewBlockWithHeader(genesis))
+	rawdb.WriteTermini(db, genesis.Hash(), []common.Hash{genesis.Hash()})
+	rawdb.WriteCanonicalHash(db, genesis.Hash(), 0)
+	rawdb.WriteHeadBlockHash(db, genesis.Hash())
+
+	config := *params.TestChainConfig
+	config.GenesisHash = genesis.Hash()
+
+	headerCache, _ := lru.New(headerCacheLimit)
+	numberCache, _ := lru.New(numberCacheLimit)
+	ancestorCache, _ := lru.New(ancestorCacheLimit)
+	blockHashesCache, _ := lru.New(blockHashesCacheLimit)
+	canonicalBlocks, _ := lru.New(canonicalBlockLimit)
+	blockCache, _ := lru.New(blockCacheLimit)
+	bodyCache, _ := lru.New(bodyCacheLimit)
+	bodyRLPCache, _ := lru.New(bodyCacheLimit)
+
+	hc := &HeaderChain{
+		config:               &config,
+		headerDb:             db,
+		headerCache:          headerCache,
+		numberCache:          numberCache,
+		ancestorCache:        ancestorCache,
+		blockHashesCache:     blockHashesCache,
+		canonicalBlocks:      canonicalBlocks,
+		genesisHeader:        genesis,
+		heads:                make([]*types.Header, 0),
+		exportReportInterval: statsReportLimit,
+		writeBatchSize:       defaultCacheConfig.WriteBatchSize,
+		quit:                 make(chan struct{}),
+	}
+	hc.bc = &BodyDb{
+		chainConfig:  &config,
+		db:           db,
+		blockCache:   blockCache,
+		bodyCache:    bodyCache,
+		bodyRLPCache: bodyRLPCache,
+	}
+	hc.currentHeader.Store(genesis)
+	return hc
+}
+
+// reopenTestHeaderChain creates a new header chain through NewHeaderChain on the
+// database of the given one, as a node restarting on it would.
+func reopenTestHeaderChain(t *testing.T, hc *HeaderChain) *HeaderChain {
+	t.Helper()
+
+	reopened, err := NewHeaderChain(hc.headerDb, testEngine{}, hc.config, nil, nil, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to reopen header chain: %v", err)
+	}
+	return reopened
+}
+
+// insertTestHeaders writes n empty blocks on top of parent into the database of
+// the header chain without touching the canonical chain. The seed differentiates
+// the headers of competing branches built on the same parent.
+func insertTestHeaders(hc *HeaderChain, parent *types.Header, n int, seed uint64) []*types.Header {
+	headers := make([]*types.Header, 0, n)
+	for i := 0; i < n; i++ {
+		header := types.EmptyHeader()
+		header.SetParentHash(parent.Hash())
+		header.SetNumber(new(big.Int).Add(parent.Number(), common.Big1))
+		header.SetDifficulty(big.NewInt(int64(100 + seed)))
+		header.SetTime(parent.Time() + 10)
+		header.SetGasUsed(uint64(i+1) * 1000)
+		header.SetNonce(types.EncodeNonce(seed))
+		header.SetLocation(common.Location{0, 0})
+
+		rawdb.WriteBlock(hc.headerDb, types.NewBlockWithHeader(header))
+		rawdb.WriteTermini(hc.headerDb, header.Hash(), []common.Hash{parent.Hash()})
+		headers = append(headers, header)
+		parent = header
+	}
+	return headers
+}
+
+// liveTestMetrics swaps the given package metrics, which are registered as
+// no-ops while metrics are disabled, for live ones until the test ends.
+func liveTestMetrics(t *testing.T, live ...interface{}) {
+	t.Helper()
+
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	t.Cleanup(func() { metrics.Enabled = enabled })
+
+	for _, metric := range live {
+		switch metric := metric.(type) {
+		case *metrics.Counter:
+			old := *metric
+			*metric = metrics.NewCounterForced()
+			t.Cleanup(func() { *metric = old })
+		case *metrics.Gauge:
+			old := *metric
+			*metric = metrics.NewGauge()
+			t.Cleanup(func() { *metric = old })
+		case *metrics.Meter:
+			old := *metric
+			*metric = metrics.NewMeterForced()
+			t.Cleanup(func() { (*metric).Stop(); *metric = old })
+		case *metrics.Timer:
+			old := *metric
+			*metric = metrics.NewTimer()
+			t.Cleanup(func() { (*metric).Stop(); *metric = old })
+		default:
+			t.Fatalf("unsupported metric type %T", metric)
+		}
+	}
+}
+
+// appendTestBlock appends the block of the given header to the header chain and
+// commits it, as the slice does.
+func appendTestBlock(t *testing.T, hc *HeaderChain, header *types.Header) {
+	t.Helper()
+
+	batch := hc.headerDb.NewBatch()
+	block := types.NewBlockWithHeader(header)
+	logs, err := hc.AppendAndCollect(batch, block, nil)
+	if err != nil {
+		t.Fatalf("failed to append block #%d: %v", header.NumberU64(), err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("failed to write block #%d: %v", header.NumberU64(), err)
+	}
+	hc.CommitBlock(block, logs)
+}
+
+// setTestCanonical advances the canonical head of the header chain through
+// each of the given headers in order.
+func setTestCanonical(t *testing.T, hc *HeaderChain, headers []*types.Header) {
+	t.Helper()
+
+	for _, header := range headers {
+		if err := hc.SetCurrentHeader(header); err != nil {
+			t.Fatalf("failed to set current header #%d: %v", header.NumberU64(), err)
+		}
+	}
+}
+
+func TestGetAncestorCache(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Fork off a side chain after block #2
+	side := insertTestHeaders(hc, canon[1], 4, 1)
+	tip := side[len(side)-1]
+
+	maxNonCanonical := uint64(10)
+	hash, number := hc.GetAncestor(tip.Hash(), tip.NumberU64(), 3, &maxNonCanonical)
+	if hash != side[0].Hash() || number != side[0].NumberU64() {
+		t.Fatalf("ancestor mismatch: have #%d [%x], want #%d [%x]", number, hash, side[0].NumberU64(), side[0].Hash())
+	}
+	if maxNonCanonical != 7 {
+		t.Fatalf("non-canonical walk length mismatch: have %d, want %d", 10-maxNonCanonical, 3)
+	}
+	// An identical query must be served from the cache without walking
+	maxNonCanonical = 10
+	hash, number = hc.GetAncestor(tip.Hash(), tip.NumberU64(), 3, &maxNonCanonical)
+	if hash != side[0].Hash() || number != side[0].NumberU64() {
+		t.Fatalf("cached ancestor mismatch: have #%d [%x], want #%d [%x]", number, hash, side[0].NumberU64(), side[0].Hash())
+	}
+	if maxNonCanonical != 10 {
+		t.Fatalf("cached query walked %d non-canonical blocks", 10-maxNonCanonical)
+	}
+	// Reorg onto the side chain and ensure stale entries are dropped
+	if err := hc.SetCurrentHeader(tip); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if n := hc.ancestorCache.Len(); n != 0 {
+		t.Fatalf("ancestor cache not invalidated on reorg: %d entries", n)
+	}
+	maxNonCanonical = 10
+	hash, number = hc.GetAncestor(tip.Hash(), tip.NumberU64(), 3, &maxNonCanonical)
+	if hash != side[0].Hash() || number != side[0].NumberU64() {
+		t.Fatalf("canonical ancestor mismatch: have #%d [%x], want #%d [%x]", number, hash, side[0].NumberU64(), side[0].Hash())
+	}
+	if maxNonCanonical != 10 {
+		t.Fatalf("canonical query walked %d non-canonical blocks", 10-maxNonCanonical)
+	}
+}
+
+func TestForkPoints(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 8, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Fork off several branches of varying length at different heights
+	forkA := insertTestHeaders(hc, canon[1], 3, 1)
+	forkB := insertTestHeaders(hc, canon[4], 2, 2)
+	forkC := insertTestHeaders(hc, forkA[0], 2, 3)
+	hc.heads = []*types.Header{canon[7], forkA[2], forkB[1], forkC[1]}
+
+	want := map[common.Hash]*types.Header{
+		canon[7].Hash(): canon[7],
+		forkA[2].Hash(): canon[1],
+		forkB[1].Hash(): canon[4],
+		forkC[1].Hash(): canon[1],
+	}
+	have := hc.ForkPoints()
+	if len(have) != len(want) {
+		t.Fatalf("fork point count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for head, forkPoint := range want {
+		if have[head] == nil {
+			t.Fatalf("missing fork point for head %x", head)
+		}
+		if have[head].Hash() != forkPoint.Hash() {
+			t.Errorf("fork point mismatch for head %x: have #%d, want #%d", head, have[head].NumberU64(), forkPoint.NumberU64())
+		}
+	}
+}
+
+func TestExportReportInterval(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+
+	var logs bytes.Buffer
+	log.Log.SetOutput(&logs)
+	defer log.Log.SetOutput(io.Discard)
+
+	// A tiny interval should report progress on nearly every block
+	hc.SetExportReportInterval(time.Nanosecond)
+	if err := hc.Export(io.Discard); err != nil {
+		t.Fatalf("failed to export chain: %v", err)
+	}
+	if n := strings.Count(logs.String(), "Exporting blocks"); n < 2 {
+		t.Fatalf("progress log count mismatch: have %d, want at least 2", n)
+	}
+	// A zero interval should silence progress reporting altogether
+	logs.Reset()
+	hc.SetExportReportInterval(0)
+	if err := hc.Export(io.Discard); err != nil {
+		t.Fatalf("failed to export chain: %v", err)
+	}
+	if n := strings.Count(logs.String(), "Exporting blocks"); n != 0 {
+		t.Fatalf("progress logged with reporting disabled: %d entries", n)
+	}
+}
+
+func TestStreamHeaders(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+
+	hashes := []common.Hash{canon[2].Hash(), {0x01}, canon[0].Hash(), canon[3].Hash()}
+	want := []*types.Header{canon[2], canon[0], canon[3]}
+
+	var have []*types.Header
+	for header := range hc.StreamHeaders(hashes) {
+		have = append(have, header)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("streamed header count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if have[i].Hash() != want[i].Hash() {
+			t.Errorf("header %d mismatch: have #%d, want #%d", i, have[i].NumberU64(), want[i].NumberU64())
+		}
+	}
+}
+
+// testEngine is a consensus engine answering every header verification with the
+// configured error, nil by default, optionally after a delay. Seals are checked
+// against sealErr alone. Any other engine method is left unimplemented.
+type testEngine struct {
+	consensus.Engine
+	verifyDelay time.Duration
+	verifyErr   error
+	sealErr     error
+}
+
+func (e testEngine) VerifyHeader(chain consensus.ChainHeaderReader, header *types.Header) error {
+	time.Sleep(e.verifyDelay)
+	return e.verifyErr
+}
+
+func (e testEngine) VerifySeal(header *types.Header) error {
+	return e.sealErr
+}
+
+// VerifyHeaderAgainst requires the difficulty of a header to match its parent's.
+func (e testEngine) VerifyHeaderAgainst(chain consensus.ChainHeaderReader, header, parent *types.Header) error {
+	if header.Difficulty().Cmp(parent.Difficulty()) != 0 {
+		return fmt.Errorf("invalid difficulty: have %v, want %v", header.Difficulty(), parent.Difficulty())
+	}
+	return e.verifyErr
+}
+
+// TotalLogS weighs each header by its own difficulty alone.
+func (testEngine) TotalLogS(header *types.Header) *big.Int {
+	return header.Difficulty()
+}
+
+func TestAppendLocationValidation(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	tests := []struct {
+		location common.Location
+		err      error
+	}{
+		{nil, ErrMalformedLocation},
+		{common.Location{0}, ErrMalformedLocation},
+		{common.Location{common.NumRegionsInPrime, 0}, ErrMalformedLocation},
+		{common.Location{0, common.NumZonesInRegion}, ErrMalformedLocation},
+		{common.Location{0, 0}, nil},
+		{common.Location{common.NumRegionsInPrime - 1, common.NumZonesInRegion - 1}, nil},
+	}
+	for i, tt := range tests {
+		header := types.CopyHeader(hc.genesisHeader)
+		header.SetParentHash(hc.genesisHeader.Hash())
+		header.SetNumber(big.NewInt(1))
+		header.SetLocation(tt.location)
+
+		batch := hc.headerDb.NewBatch()
+		if err := hc.Append(batch, types.NewBlockWithHeader(header), nil); err != tt.err {
+			t.Errorf("test %d: append error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestReorgEvent(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+
+	events := make(chan ReorgEvent, 1)
+	sub := hc.SubscribeReorgEvent(events)
+	defer sub.Unsubscribe()
+
+	// Moving the head forward over several blocks at once drops nothing
+	if err := hc.SetCurrentHeader(canon[2]); err != nil {
+		t.Fatalf("failed to set head: %v", err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("reorg event delivered without dropped blocks: %v", ev)
+	default:
+	}
+	// Build a competing 3 block branch replacing the last 2 canonical blocks
+	side := insertTestHeaders(hc, canon[0], 3, 1)
+
+	if err := hc.SetCurrentHeader(side[2]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	var ev ReorgEvent
+	select {
+	case ev = <-events:
+	default:
+		t.Fatalf("no reorg event delivered")
+	}
+	checkChain := func(name string, have, want []*types.Header) {
+		if len(have) != len(want) {
+			t.Fatalf("%s chain length mismatch: have %d, want %d", name, len(have), len(want))
+		}
+		for i := range want {
+			if have[i].Hash() != want[i].Hash() {
+				t.Errorf("%s chain header %d mismatch: have #%d [%x], want #%d [%x]", name, i, have[i].NumberU64(), have[i].Hash(), want[i].NumberU64(), want[i].Hash())
+			}
+		}
+	}
+	checkChain("old", ev.OldChain, []*types.Header{canon[2], canon[1]})
+	checkChain("new", ev.NewChain, []*types.Header{side[2], side[1], side[0]})
+}
+
+func TestCurrentHeaderConcurrentAccess(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 32, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, header := range canon {
+			hc.SetCurrentHeader(header)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if hash := hc.CurrentHeader().Hash(); hash != canon[len(canon)-1].Hash() {
+				t.Fatalf("head mismatch: have %x, want %x", hash, canon[len(canon)-1].Hash())
+			}
+			return
+		default:
+			if hc.CurrentHeader().Hash() == (common.Hash{}) {
+				t.Fatalf("read empty head hash")
+			}
+		}
+	}
+}
+
+func TestBodyCacheMeters(t *testing.T) {
+	liveTestMetrics(t, &bodyCacheHitMeter, &bodyCacheMissMeter)
+
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	check := func(hits, misses int64) {
+		t.Helper()
+		if have := bodyCacheHitMeter.Count(); have != hits {
+			t.Errorf("body cache hit count mismatch: have %d, want %d", have, hits)
+		}
+		if have := bodyCacheMissMeter.Count(); have != misses {
+			t.Errorf("body cache miss count mismatch: have %d, want %d", have, misses)
+		}
+	}
+	// Novel requests go to the database, repeated ones hit the cache
+	hc.GetBody(canon[0].Hash())
+	check(0, 1)
+	hc.GetBody(canon[0].Hash())
+	check(1, 1)
+	hc.GetBody(canon[1].Hash())
+	check(1, 2)
+
+	// The RLP cache is tracked independently of the decoded one
+	hc.GetBodyRLP(canon[0].Hash())
+	check(1, 3)
+	hc.GetBodyRLP(canon[0].Hash())
+	check(2, 3)
+}
+
+func TestHeadsByEntropy(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	// Create competing heads at the same height but with distinct entropy,
+	// plus two with identical entropy to exercise the tie break
+	light := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+	heavy := insertTestHeaders(hc, hc.genesisHeader, 2, 5)
+	middle := insertTestHeaders(hc, hc.genesisHeader, 2, 3)
+	tied := types.CopyHeader(middle[1])
+	tied.SetTime(tied.Time() + 1)
+	hc.heads = []*types.Header{light[1], middle[1], heavy[1], tied}
+
+	tiedFirst, tiedSecond := middle[1], tied
+	if hashA, hashB := tiedFirst.Hash(), tiedSecond.Hash(); bytes.Compare(hashA[:], hashB[:]) > 0 {
+		tiedFirst, tiedSecond = tiedSecond, tiedFirst
+	}
+	want := []*types.Header{heavy[1], tiedFirst, tiedSecond, light[1]}
+	for run := 0; run < 3; run++ {
+		have := hc.HeadsByEntropy()
+		if len(have) != len(want) {
+			t.Fatalf("head count mismatch: have %d, want %d", len(have), len(want))
+		}
+		for i := range want {
+			if have[i].Hash() != want[i].Hash() {
+				t.Fatalf("run %d: head %d mismatch: have %x, want %x", run, i, have[i].Hash(), want[i].Hash())
+			}
+		}
+	}
+	// The internal heads order must be left untouched
+	if hc.heads[0] != light[1] || hc.heads[2] != heavy[1] {
+		t.Fatalf("internal heads were reordered")
+	}
+}
+
+func TestAppendHeadsIdempotent(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, canon[0], 1, 1)
+
+	for _, header := range []*types.Header{canon[0], canon[1], side[0], canon[1], side[0]} {
+		appendTestBlock(t, hc, header)
+	}
+	if len(hc.heads) != 2 {
+		t.Fatalf("heads count mismatch: have %d, want %d", len(hc.heads), 2)
+	}
+	seen := make(map[common.Hash]int)
+	for _, head := range hc.heads {
+		seen[head.Hash()]++
+	}
+	for _, head := range []*types.Header{canon[1], side[0]} {
+		if seen[head.Hash()] != 1 {
+			t.Errorf("head #%d [%x] tracked %d times", head.NumberU64(), head.Hash(), seen[head.Hash()])
+		}
+	}
+}
+
+func TestGetGasUsedInChainByHeader(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	tip := canon[len(canon)-1]
+
+	for _, length := range []int{0, 1, 3, 6, 7, 10} {
+		want := hc.GetGasUsedInChain(hc.GetBlock(tip.Hash(), tip.NumberU64()), length)
+		if have := hc.GetGasUsedInChainByHeader(tip, length); have != want {
+			t.Errorf("length %d: gas used mismatch: have %d, want %d", length, have, want)
+		}
+	}
+}
+
+// cancelWriter buffers everything written to it, cancelling a context on the
+// first write.
+type cancelWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(p)
+}
+
+func TestExportWithContextCancel(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &cancelWriter{cancel: cancel}
+	if err := hc.ExportWithContext(ctx, w, 0, 5); err != context.Canceled {
+		t.Fatalf("export error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	// Only the block being written when cancelled may have been exported
+	genesis, err := rlp.EncodeToBytes(hc.GetBlockByNumber(0))
+	if err != nil {
+		t.Fatalf("failed to encode genesis block: %v", err)
+	}
+	if !bytes.Equal(w.Bytes(), genesis) {
+		t.Fatalf("export continued after cancellation: have %d bytes, want %d", w.Len(), len(genesis))
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, headerCacheLimit+10, 0)
+
+	for _, header := range canon[:10] {
+		hc.GetHeaderByHash(header.Hash())
+	}
+	if headers, numbers, ancestors := hc.CacheStats(); headers != 10 || numbers != 10 || ancestors != 0 {
+		t.Fatalf("cache stats mismatch: have (%d, %d, %d), want (%d, %d, %d)", headers, numbers, ancestors, 10, 10, 0)
+	}
+	// Overflow the header cache, the number cache is larger and keeps everything
+	for _, header := range canon {
+		hc.GetHeaderByHash(header.Hash())
+	}
+	if headers, numbers, _ := hc.CacheStats(); headers != headerCacheLimit || numbers != len(canon) {
+		t.Fatalf("cache stats mismatch: have (%d, %d), want (%d, %d)", headers, numbers, headerCacheLimit, len(canon))
+	}
+	// A non-canonical ancestor lookup populates the ancestor cache
+	maxNonCanonical := uint64(10)
+	tip := canon[len(canon)-1]
+	hc.GetAncestor(tip.Hash(), tip.NumberU64(), 2, &maxNonCanonical)
+	if _, _, ancestors := hc.CacheStats(); ancestors != 1 {
+		t.Fatalf("ancestor cache length mismatch: have %d, want %d", ancestors, 1)
+	}
+}
+
+func TestAppendAndCollect(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+
+	events := make(chan ChainEvent, 1)
+	sub := hc.bc.SubscribeChainEvent(events)
+	defer sub.Unsubscribe()
+
+	batch := hc.headerDb.NewBatch()
+	block := types.NewBlockWithHeader(canon[0])
+	logs, err := hc.AppendAndCollect(batch, block, nil)
+	if err != nil {
+		t.Fatalf("failed to append block: %v", err)
+	}
+	// Nothing is tracked or announced until the batch is committed
+	select {
+	case ev := <-events:
+		t.Fatalf("chain event delivered before commit: %x", ev.Hash)
+	default:
+	}
+	if len(hc.heads) != 0 {
+		t.Fatalf("uncommitted block tracked as head: %v", hc.heads)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("failed to write block: %v", err)
+	}
+	hc.CommitBlock(block, logs)
+	if len(hc.heads) != 1 || hc.heads[0].Hash() != block.Hash() {
+		t.Fatalf("heads mismatch: have %v, want [%x]", hc.heads, block.Hash())
+	}
+	select {
+	case ev := <-events:
+		if ev.Hash != block.Hash() {
+			t.Fatalf("chain event hash mismatch: have %x, want %x", ev.Hash, block.Hash())
+		}
+		if len(ev.Logs) != len(logs) {
+			t.Fatalf("log count mismatch: have %d, want %d", len(logs), len(ev.Logs))
+		}
+		for i := range logs {
+			if logs[i] != ev.Logs[i] {
+				t.Errorf("log %d mismatch: have %v, want %v", i, logs[i], ev.Logs[i])
+			}
+		}
+	default:
+		t.Fatalf("no chain event delivered")
+	}
+}
+
+func TestNewHeaderChainGenesisCheck(t *testing.T) {
+	// A database without any genesis must be refused
+	config := *params.TestChainConfig
+	if _, err := NewHeaderChain(rawdb.NewMemoryDatabase(), testEngine{}, &config, nil, nil, vm.Config{}); err != ErrNoGenesis {
+		t.Fatalf("missing genesis error mismatch: have %v, want %v", err, ErrNoGenesis)
+	}
+	// A database holding the genesis of another network must be refused too
+	hc := newTestHeaderChain(t)
+	config.GenesisHash = common.Hash{0x01}
+
+	_, err := NewHeaderChain(hc.headerDb, testEngine{}, &config, nil, nil, vm.Config{})
+	mismatch, ok := err.(*GenesisMismatchError)
+	if !ok {
+		t.Fatalf("genesis mismatch error type mismatch: have %T (%v), want %T", err, err, mismatch)
+	}
+	if mismatch.Stored != hc.genesisHeader.Hash() || mismatch.New != config.GenesisHash {
+		t.Fatalf("genesis mismatch error content mismatch: have (%x, %x), want (%x, %x)", mismatch.Stored, mismatch.New, hc.genesisHeader.Hash(), config.GenesisHash)
+	}
+}
+
+func TestGetBlockHashesFromHashCache(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	tip := canon[len(canon)-1]
+
+	want := []common.Hash{canon[4].Hash(), canon[3].Hash(), canon[2].Hash()}
+	check := func(have []common.Hash) {
+		t.Helper()
+		if len(have) != len(want) {
+			t.Fatalf("hash count mismatch: have %d, want %d", len(have), len(want))
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				t.Fatalf("hash %d mismatch: have %x, want %x", i, have[i], want[i])
+			}
+		}
+	}
+	check(hc.GetBlockHashesFromHash(tip.Hash(), 3))
+	if !hc.blockHashesCache.Contains(blockHashesKey{hash: tip.Hash(), max: 3}) {
+		t.Fatalf("hash list not cached")
+	}
+	// Mutating a returned list must not corrupt the cached one
+	hashes := hc.GetBlockHashesFromHash(tip.Hash(), 3)
+	hashes[0] = common.Hash{}
+	check(hc.GetBlockHashesFromHash(tip.Hash(), 3))
+
+	// Deleting the headers, here as unreachable orphans, must drop the list
+	if _, err := hc.PruneOrphans(tip.NumberU64()); err != nil {
+		t.Fatalf("failed to prune orphans: %v", err)
+	}
+	if hashes := hc.GetBlockHashesFromHash(tip.Hash(), 3); len(hashes) != 0 {
+		t.Fatalf("deleted hashes served: %x", hashes)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	setTestCanonical(t, hc, canon)
+
+	var buf bytes.Buffer
+	if err := hc.ExportJSON(&buf, 1, 3); err != nil {
+		t.Fatalf("failed to export chain: %v", err)
+	}
+	var exported []struct {
+		Hash       common.Hash    `json:"hash"`
+		ParentHash []common.Hash  `json:"parentHash"`
+		Number     []*hexutil.Big `json:"number"`
+		Location   hexutil.Bytes  `json:"location"`
+		Difficulty *hexutil.Big   `json:"difficulty"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("failed to decode export: %v", err)
+	}
+	if len(exported) != 3 {
+		t.Fatalf("exported header count mismatch: have %d, want %d", len(exported), 3)
+	}
+	for i, have := range exported {
+		want := canon[i]
+		if have.Hash != want.Hash() {
+			t.Errorf("header %d: hash mismatch: have %x, want %x", i, have.Hash, want.Hash())
+		}
+		if have.ParentHash[common.PRIME_CTX] != want.ParentHash() {
+			t.Errorf("header %d: parent hash mismatch: have %x, want %x", i, have.ParentHash[common.PRIME_CTX], want.ParentHash())
+		}
+		if have.Number[common.PRIME_CTX].ToInt().Uint64() != want.NumberU64() {
+			t.Errorf("header %d: number mismatch: have %v, want %d", i, have.Number[common.PRIME_CTX], want.NumberU64())
+		}
+		if !bytes.Equal(have.Location, want.Location()) {
+			t.Errorf("header %d: location mismatch: have %v, want %v", i, have.Location, want.Location())
+		}
+		if have.Difficulty.ToInt().Cmp(want.Difficulty()) != 0 {
+			t.Errorf("header %d: difficulty mismatch: have %v, want %v", i, have.Difficulty, want.Difficulty())
+		}
+	}
+	// Exporting beyond the head must fail
+	if err := hc.ExportJSON(io.Discard, 3, 5); err == nil {
+		t.Fatalf("export beyond the head succeeded")
+	}
+}
+
+func TestAppendPolicy(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	errBlacklisted := errors.New("blacklisted")
+	blacklist := func(header *types.Header) error {
+		if header.Hash() == canon[1].Hash() {
+			return errBlacklisted
+		}
+		return nil
+	}
+	allowAll := func(header *types.Header) error { return nil }
+
+	tests := []struct {
+		policy func(*types.Header) error
+		errs   []error
+	}{
+		{nil, []error{nil, nil}},
+		{allowAll, []error{nil, nil}},
+		{blacklist, []error{nil, errBlacklisted}},
+	}
+	for i, tt := range tests {
+		hc.SetAppendPolicy(tt.policy)
+		for j, header := range canon {
+			if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(header), nil); err != tt.errs[j] {
+				t.Errorf("test %d, block %d: append error mismatch: have %v, want %v", i, j, err, tt.errs[j])
+			}
+		}
+	}
+}
+
+// readRecordingDb wraps a database, recording the keys of every lookup.
+type readRecordingDb struct {
+	ethdb.Database
+	keys [][]byte
+}
+
+func (db *readRecordingDb) Has(key []byte) (bool, error) {
+	db.keys = append(db.keys, common.CopyBytes(key))
+	return db.Database.Has(key)
+}
+
+func (db *readRecordingDb) Get(key []byte) ([]byte, error) {
+	db.keys = append(db.keys, common.CopyBytes(key))
+	return db.Database.Get(key)
+}
+
+func TestGenesisWalkUnderflow(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon)
+
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb, hc.bc.db = db, db
+	hc.headerCache.Purge()
+	hc.bc.blockCache.Purge()
+
+	genesis := hc.genesisHeader
+	if hashes := hc.GetBlockHashesFromHash(genesis.Hash(), 4); len(hashes) != 0 {
+		t.Errorf("hashes found beyond genesis: %d", len(hashes))
+	}
+	maxNonCanonical := uint64(4)
+	if hash, _ := hc.GetAncestor(genesis.Hash(), 0, 1, &maxNonCanonical); hash != (common.Hash{}) {
+		t.Errorf("ancestor found beyond genesis: %x", hash)
+	}
+	if blocks := hc.GetBlocksFromHash(genesis.Hash(), 4); len(blocks) != 1 {
+		t.Errorf("block count mismatch: have %d, want %d", len(blocks), 1)
+	}
+	genesisBlock := hc.GetBlock(genesis.Hash(), 0)
+	hc.GetUnclesInChain(genesisBlock, 4)
+	hc.GetGasUsedInChain(genesisBlock, 4)
+	if err := hc.SetCurrentHeader(genesis); err != nil {
+		t.Fatalf("failed to rewind to genesis: %v", err)
+	}
+	// None of the above may look up the parent of the genesis
+	underflow := bytes.Repeat([]byte{0xff}, 8)
+	for _, key := range db.keys {
+		if bytes.Contains(key, underflow) {
+			t.Fatalf("underflowed number looked up: %x", key)
+		}
+		if bytes.HasSuffix(key, common.Hash{}.Bytes()) {
+			t.Fatalf("genesis parent looked up: %x", key)
+		}
+	}
+}
+
+func TestAppendTimers(t *testing.T) {
+	tests := []struct {
+		name  string
+		timer *metrics.Timer
+		stall func(hc *HeaderChain, delay time.Duration)
+	}{
+		{
+			name:  "append",
+			timer: &appendTimer,
+			stall: func(hc *HeaderChain, delay time.Duration) { hc.engine = testEngine{verifyDelay: delay} },
+		},
+		{
+			// A held read lock stalls taking the write lock on the heads
+			name:  "headlock",
+			timer: &headLockTimer,
+			stall: func(hc *HeaderChain, delay time.Duration) {
+				locked := make(chan struct{})
+				go func() {
+					hc.headermu.RLock()
+					close(locked)
+					time.Sleep(delay)
+					hc.headermu.RUnlock()
+				}()
+				<-locked
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			liveTestMetrics(t, tt.timer)
+
+			delay := 50 * time.Millisecond
+			hc := newTestHeaderChain(t)
+			hc.engine = testEngine{}
+			canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+
+			tt.stall(hc, delay)
+			appendTestBlock(t, hc, canon[0])
+			if count := (*tt.timer).Count(); count != 1 {
+				t.Fatalf("timer count mismatch: have %d, want %d", count, 1)
+			}
+			if max := time.Duration((*tt.timer).Max()); max < delay/2 {
+				t.Fatalf("timed duration too short: have %v, want at least %v", max, delay/2)
+			}
+		})
+	}
+}
+
+func TestGetHeaderByNumberOnBranch(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Fork off a side chain after block #2 and look up headers along it
+	side := insertTestHeaders(hc, canon[1], 4, 1)
+	tip := side[len(side)-1]
+
+	for _, want := range append([]*types.Header{hc.genesisHeader, canon[0], canon[1]}, side...) {
+		header, err := hc.GetHeaderByNumberOnBranch(tip.Hash(), want.NumberU64())
+		if err != nil {
+			t.Fatalf("failed to retrieve #%d on branch: %v", want.NumberU64(), err)
+		}
+		if header.Hash() != want.Hash() {
+			t.Fatalf("header #%d mismatch: have %x, want %x", want.NumberU64(), header.Hash(), want.Hash())
+		}
+	}
+	if canonical := hc.GetHeaderByNumber(side[0].NumberU64()); canonical.Hash() == side[0].Hash() {
+		t.Fatalf("side chain header #%d unexpectedly canonical", side[0].NumberU64())
+	}
+	// Numbers above the tip of the branch are rejected
+	if _, err := hc.GetHeaderByNumberOnBranch(tip.Hash(), tip.NumberU64()+1); err == nil {
+		t.Fatalf("expected error retrieving #%d above branch tip #%d", tip.NumberU64()+1, tip.NumberU64())
+	}
+}
+
+func TestPing(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	if err := hc.Ping(); err != nil {
+		t.Fatalf("healthy database failed ping: %v", err)
+	}
+	hc.headerDb.Close()
+	if err := hc.Ping(); err == nil {
+		t.Fatalf("closed database passed ping")
+	}
+}
+
+func TestGetBlockByHashCachedHeader(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon)
+
+	header := canon[1]
+	hc.headerCache.Add(header.Hash(), header)
+	hc.numberCache.Purge()
+
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb, hc.bc.db = db, db
+
+	block := hc.GetBlockByHash(header.Hash())
+	if block == nil || block.Hash() != header.Hash() {
+		t.Fatalf("block mismatch: have %v, want %x", block, header.Hash())
+	}
+	if hc.numberCache.Contains(header.Hash()) {
+		t.Fatalf("number cache consulted for cached header")
+	}
+	// The hash->number mapping is stored under the "H" prefix
+	numberKey := append([]byte("H"), header.Hash().Bytes()...)
+	for _, key := range db.keys {
+		if bytes.Equal(key, numberKey) {
+			t.Fatalf("database consulted for the number of a cached header")
+		}
+	}
+}
+
+func TestAppendRejectCounters(t *testing.T) {
+	counters := []*metrics.Counter{
+		&appendRejectLocationCounter,
+		&appendRejectPolicyCounter,
+		&appendRejectUnknownParentCounter,
+		&appendRejectNonContiguousCounter,
+		&appendRejectBadHeaderCounter,
+	}
+	for _, counter := range counters {
+		liveTestMetrics(t, counter)
+	}
+	errPolicy := errors.New("rejected by policy")
+	errBadSeal := errors.New("invalid proof-of-work")
+
+	tests := []struct {
+		location  common.Location
+		policy    func(*types.Header) error
+		verifyErr error
+		counter   *metrics.Counter
+	}{
+		{location: common.Location{0}, counter: &appendRejectLocationCounter},
+		{policy: func(*types.Header) error { return errPolicy }, counter: &appendRejectPolicyCounter},
+		{verifyErr: consensus.ErrUnknownAncestor, counter: &appendRejectUnknownParentCounter},
+		{verifyErr: consensus.ErrInvalidNumber, counter: &appendRejectNonContiguousCounter},
+		{verifyErr: errBadSeal, counter: &appendRejectBadHeaderCounter},
+	}
+	for i, tt := range tests {
+		hc := newTestHeaderChain(t)
+		hc.engine = testEngine{verifyErr: tt.verifyErr}
+		hc.SetAppendPolicy(tt.policy)
+
+		header := insertTestHeaders(hc, hc.genesisHeader, 1, 0)[0]
+		if tt.location != nil {
+			header.SetLocation(tt.location)
+		}
+		if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(header), nil); err == nil {
+			t.Fatalf("test %d: append succeeded", i)
+		}
+		for j, counter := range counters {
+			want := int64(0)
+			if j <= i {
+				want = 1
+			}
+			if have := (*counter).Count(); have != want {
+				t.Errorf("test %d: counter %d mismatch: have %d, want %d", i, j, have, want)
+			}
+		}
+	}
+}
+
+func TestBranchLength(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	side := insertTestHeaders(hc, canon[0], 4, 1)
+
+	for _, tip := range []*types.Header{hc.genesisHeader, canon[2], side[3]} {
+		length, err := hc.BranchLength(tip.Hash())
+		if err != nil {
+			t.Fatalf("failed to measure branch #%d: %v", tip.NumberU64(), err)
+		}
+		if length != tip.NumberU64() {
+			t.Fatalf("branch length mismatch: have %d, want %d", length, tip.NumberU64())
+		}
+	}
+	// Drop an ancestor of the side chain to break it
+	rawdb.DeleteHeader(hc.headerDb, side[1].Hash(), side[1].NumberU64())
+	hc.headerCache.Purge()
+	hc.numberCache.Purge()
+
+	if _, err := hc.BranchLength(side[3].Hash()); err == nil {
+		t.Fatalf("broken branch measured successfully")
+	}
+}
+
+// testHeaderKey returns the database key of the given header, which is stored
+// under the "h" prefix followed by its number and hash.
+func testHeaderKey(header *types.Header) []byte {
+	key := make([]byte, 9, 9+common.HashLength)
+	key[0] = 'h'
+	binary.BigEndian.PutUint64(key[1:], header.NumberU64())
+	return append(key, header.Hash().Bytes()...)
+}
+
+func TestPrefetchHeaders(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 8, 0)
+
+	hashes := make([]common.Hash, 0, len(canon)+1)
+	for _, header := range canon {
+		hashes = append(hashes, header.Hash())
+	}
+	hashes = append(hashes, common.Hash{0x01})
+	<-hc.PrefetchHeaders(hashes)
+
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb = db
+	for _, header := range canon {
+		if cached := hc.GetHeader(header.Hash(), header.NumberU64()); cached == nil || cached.Hash() != header.Hash() {
+			t.Fatalf("header #%d mismatch: have %v, want %x", header.NumberU64(), cached, header.Hash())
+		}
+		headerKey := testHeaderKey(header)
+		for _, key := range db.keys {
+			if bytes.Equal(key, headerKey) {
+				t.Fatalf("database read for prefetched header #%d", header.NumberU64())
+			}
+		}
+	}
+}
+
+func TestLoadLastStateMissingHead(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Persist a head whose header never made it to disk
+	missing := common.Hash{0x01}
+	rawdb.WriteHeadsHashes(hc.headerDb, []common.Hash{canon[1].Hash(), missing})
+	rawdb.WriteHeadBlockHash(hc.headerDb, canon[1].Hash())
+
+	hc = reopenTestHeaderChain(t, hc)
+	if len(hc.heads) != 1 || hc.heads[0].Hash() != canon[1].Hash() {
+		t.Fatalf("heads mismatch: have %v, want [%x]", hc.heads, canon[1].Hash())
+	}
+	if head := hc.CurrentHeader(); head.Hash() != canon[1].Hash() {
+		t.Fatalf("current header mismatch: have %x, want %x", head.Hash(), canon[1].Hash())
+	}
+}
+
+func TestGetEntropies(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, hc.genesisHeader, 1, 5)
+
+	hashes := []common.Hash{side[0].Hash(), {0x01}, canon[1].Hash(), canon[0].Hash()}
+	want := []*big.Int{big.NewInt(105), nil, big.NewInt(100), big.NewInt(100)}
+
+	entropies := hc.GetEntropies(hashes)
+	if len(entropies) != len(want) {
+		t.Fatalf("entropy count mismatch: have %d, want %d", len(entropies), len(want))
+	}
+	for i := range want {
+		if (entropies[i] == nil) != (want[i] == nil) || (want[i] != nil && entropies[i].Cmp(want[i]) != 0) {
+			t.Errorf("entropy %d mismatch: have %v, want %v", i, entropies[i], want[i])
+		}
+	}
+}
+
+func TestVerifyCanonicalChain(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+
+	if err := hc.VerifyCanonicalChain(0, 5); err != nil {
+		t.Fatalf("healthy chain failed verification: %v", err)
+	}
+	// Make a header with a foreign parent canonical at #3
+	side := insertTestHeaders(hc, hc.genesisHeader, 3, 1)
+	rawdb.WriteCanonicalHash(hc.headerDb, side[2].Hash(), 3)
+
+	if err := hc.VerifyCanonicalChain(1, 2); err != nil {
+		t.Fatalf("healthy range failed verification: %v", err)
+	}
+	err := hc.VerifyCanonicalChain(0, 5)
+	if err == nil {
+		t.Fatalf("corrupted chain passed verification")
+	}
+	if !strings.Contains(err.Error(), "#3") {
+		t.Fatalf("error does not name the break at #3: %v", err)
+	}
+}
+
+func TestExportHeadersN(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	setTestCanonical(t, hc, canon)
+
+	var headers, blocks bytes.Buffer
+	if err := hc.ExportHeadersN(&headers, 1, 4); err != nil {
+		t.Fatalf("failed to export headers: %v", err)
+	}
+	if err := hc.ExportN(&blocks, 1, 4); err != nil {
+		t.Fatalf("failed to export blocks: %v", err)
+	}
+	if headers.Len() >= blocks.Len() {
+		t.Fatalf("headers-only export not smaller: have %d bytes, full export %d bytes", headers.Len(), blocks.Len())
+	}
+	headerStream, blockStream := rlp.NewStream(&headers, 0), rlp.NewStream(&blocks, 0)
+	for _, want := range canon {
+		header := new(types.Header)
+		if err := headerStream.Decode(header); err != nil {
+			t.Fatalf("failed to decode header #%d: %v", want.NumberU64(), err)
+		}
+		if header.Hash() != want.Hash() {
+			t.Fatalf("header #%d mismatch: have %x, want %x", want.NumberU64(), header.Hash(), want.Hash())
+		}
+		block := new(types.Block)
+		if err := blockStream.Decode(block); err != nil {
+			t.Fatalf("failed to decode block #%d: %v", want.NumberU64(), err)
+		}
+		if block.Hash() != want.Hash() {
+			t.Fatalf("block #%d mismatch: have %x, want %x", want.NumberU64(), block.Hash(), want.Hash())
+		}
+	}
+	if err := headerStream.Decode(new(types.Header)); err != io.EOF {
+		t.Fatalf("trailing data after headers: %v", err)
+	}
+}
+
+func TestSlowSubscriberDoesNotBlockAppend(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon[:2])
+	side := insertTestHeaders(hc, hc.genesisHeader, 3, 1)
+
+	// Subscribe to every header chain feed without ever reading
+	heads, sides, reorgs := make(chan ChainHeadEvent), make(chan ChainSideEvent), make(chan ReorgEvent)
+	subs := []event.Subscription{
+		hc.SubscribeChainHeadEvent(heads),
+		hc.SubscribeChainSideEvent(sides),
+		hc.SubscribeReorgEvent(reorgs),
+	}
+	reorged := make(chan error, 1)
+	go func() { reorged <- hc.SetCurrentHeader(side[2]) }()
+	for hc.CurrentHeader().Hash() != side[2].Hash() {
+		time.Sleep(time.Millisecond)
+	}
+
+	appended := make(chan error, 1)
+	go func() {
+		batch := hc.headerDb.NewBatch()
+		block := types.NewBlockWithHeader(canon[2])
+		logs, err := hc.AppendAndCollect(batch, block, nil)
+		if err == nil {
+			err = batch.Write()
+		}
+		if err == nil {
+			hc.CommitBlock(block, logs)
+		}
+		appended <- err
+	}()
+	select {
+	case err := <-appended:
+		if err != nil {
+			t.Fatalf("failed to append block: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("append blocked by slow subscriber")
+	}
+	// Dropping the subscriptions releases the pending reorg event
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	if err := <-reorged; err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+}
+
+func TestPruneOrphans(t *testing.T) {
+	liveTestMetrics(t, &pruneHeadersMeter)
+
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	side := insertTestHeaders(hc, canon[0], 3, 1)
+
+	// Reorg away from the side chain, orphaning it
+	setTestCanonical(t, hc, side)
+	setTestCanonical(t, hc, canon[1:])
+
+	// Keep a competing branch alive through a tracked head
+	tracked := insertTestHeaders(hc, hc.genesisHeader, 2, 2)
+	hc.addHead(tracked[1])
+
+	// Resolve the orphans through the hash list and ancestor caches
+	maxNonCanonical := uint64(ancestorMaxNonCanon)
+	if hashes := hc.GetBlockHashesFromHash(side[2].Hash(), 2); len(hashes) != 2 {
+		t.Fatalf("orphan hash count mismatch: have %d, want %d", len(hashes), 2)
+	}
+	if hash, _ := hc.GetAncestor(side[2].Hash(), side[2].NumberU64(), 2, &maxNonCanonical); hash != side[0].Hash() {
+		t.Fatalf("orphan ancestor mismatch: have %x, want %x", hash, side[0].Hash())
+	}
+	pruned, err := hc.PruneOrphans(side[2].NumberU64())
+	if err != nil {
+		t.Fatalf("failed to prune orphans: %v", err)
+	}
+	if pruned != 2 {
+		t.Fatalf("pruned count mismatch: have %d, want %d", pruned, 2)
+	}
+	if count := pruneHeadersMeter.Count(); count != int64(pruned) {
+		t.Fatalf("prune meter mismatch: have %d, want %d", count, pruned)
+	}
+	for _, header := range side[:2] {
+		if hc.GetHeaderByHash(header.Hash()) != nil || hc.GetBlockByHash(header.Hash()) != nil {
+			t.Errorf("orphan #%d [%x] survived pruning", header.NumberU64(), header.Hash())
+		}
+	}
+	if hashes := hc.GetBlockHashesFromHash(side[2].Hash(), 2); len(hashes) != 0 {
+		t.Errorf("pruned hashes served from the cache: %x", hashes)
+	}
+	maxNonCanonical = ancestorMaxNonCanon
+	if hash, _ := hc.GetAncestor(side[2].Hash(), side[2].NumberU64(), 2, &maxNonCanonical); hash != (common.Hash{}) {
+		t.Errorf("pruned ancestor served from the cache: %x", hash)
+	}
+	// Blocks at or above the bound are left alone, as is everything reachable
+	survivors := append([]*types.Header{hc.genesisHeader, side[2]}, canon...)
+	for _, header := range append(survivors, tracked...) {
+		if hc.GetHeaderByHash(header.Hash()) == nil {
+			t.Errorf("block #%d [%x] pruned", header.NumberU64(), header.Hash())
+		}
+	}
+}
+
+func TestPruneOrphansTxLookups(t *testing.T) {
+	// Only zones index transactions
+	defer func(location common.Location) { common.NodeLocation = location }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	hc := newTestHeaderChain(t)
+	txLookupCache, _ := lru.New(txLookupCacheLimit)
+	hc.bc.processor = &StateProcessor{config: hc.config, hc: hc, txLookupCache: txLookupCache}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+
+	// Include one transaction only on the orphaned branch and one on both
+	to := common.HexToAddress("0x1")
+	orphanTx := types.NewTx(&types.InternalTx{ChainID: hc.config.ChainID, Nonce: 1, Gas: 21000, To: &to, Value: big.NewInt(1)})
+	sharedTx := types.NewTx(&types.InternalTx{ChainID: hc.config.ChainID, Nonce: 2, Gas: 21000, To: &to, Value: big.NewInt(2)})
+	for _, entry := range []struct {
+		header *types.Header
+		txs    types.Transactions
+	}{{side[0], types.Transactions{orphanTx, sharedTx}}, {canon[1], types.Transactions{sharedTx}}} {
+		block := types.NewBlockWithHeader(entry.header).WithBody(entry.txs, nil, nil, nil)
+		rawdb.WriteBody(hc.headerDb, block.Hash(), block.NumberU64(), block.Body())
+		rawdb.WriteTxLookupEntriesByBlock(hc.headerDb, block)
+	}
+	setTestCanonical(t, hc, canon)
+	hc.bc.processor.txLookupCache.Add(orphanTx.Hash(), &rawdb.LegacyTxLookupEntry{BlockHash: side[0].Hash()})
+
+	if _, err := hc.PruneOrphans(side[1].NumberU64() + 1); err != nil {
+		t.Fatalf("failed to prune orphans: %v", err)
+	}
+	if entry := rawdb.ReadTxLookupEntry(hc.headerDb, orphanTx.Hash()); entry != nil {
+		t.Errorf("pruned transaction still indexed at #%d", *entry)
+	}
+	if hc.bc.processor.txLookupCache.Contains(orphanTx.Hash()) {
+		t.Errorf("pruned transaction lookup still cached")
+	}
+	if lookup := hc.bc.processor.GetTransactionLookup(sharedTx.Hash()); lookup == nil || lookup.BlockHash != canon[1].Hash() {
+		t.Errorf("canonical transaction lookup mismatch: %v", lookup)
+	}
+}
+
+func TestPruneOrphansUnlockedScan(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 30, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Make the scan slow by walking the chain from an uncached database
+	hc.headerCache.Purge()
+	hc.numberCache.Purge()
+	hc.headerDb = &slowDb{Database: hc.headerDb, delay: 5 * time.Millisecond}
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := hc.PruneOrphans(canon[len(canon)-1].NumberU64())
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The heads must be writable while the scan is in progress
+	hc.headermu.Lock()
+	locked := time.Since(start)
+	hc.headermu.Unlock()
+
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to prune orphans: %v", err)
+	}
+	if elapsed := time.Since(start); locked >= elapsed/2 {
+		t.Fatalf("heads lock held during the scan: acquired after %v of %v", locked, elapsed)
+	}
+}
+
+func TestIsCanonical(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	setTestCanonical(t, hc, canon)
+	side := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+
+	tests := []struct {
+		hash   common.Hash
+		number uint64
+		want   bool
+	}{
+		{hc.genesisHeader.Hash(), 0, true},
+		{canon[1].Hash(), 2, true},
+		{side[1].Hash(), 2, false},
+		{canon[1].Hash(), 1, false},
+		{canon[1].Hash(), 3, false},
+	}
+	for i, tt := range tests {
+		if have := hc.IsCanonical(tt.hash, tt.number); have != tt.want {
+			t.Errorf("test %d: canonical mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+func TestHeadAge(t *testing.T) {
+	hc := newTestHeaderChain(t)
+
+	past := types.CopyHeader(hc.genesisHeader)
+	past.SetTime(uint64(time.Now().Add(-time.Hour).Unix()))
+	hc.currentHeader.Store(past)
+	if age := hc.HeadAge(); age < time.Hour {
+		t.Fatalf("past head age mismatch: have %v, want at least %v", age, time.Hour)
+	}
+	future := types.CopyHeader(hc.genesisHeader)
+	future.SetTime(uint64(time.Now().Add(time.Hour).Unix()))
+	hc.currentHeader.Store(future)
+	if age := hc.HeadAge(); age != 0 {
+		t.Fatalf("future head age mismatch: have %v, want 0", age)
+	}
+}
+
+func TestGetHeadersByNumberRange(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+
+	tests := []struct {
+		first, last uint64
+		want        []*types.Header
+	}{
+		{0, 5, append([]*types.Header{hc.genesisHeader}, canon...)},
+		{2, 4, canon[1:4]},
+		{3, 3, canon[2:3]},
+		{4, 2, nil},
+		{3, math.MaxUint64, canon[2:]},
+		{6, 8, nil},
+	}
+	for i, tt := range tests {
+		forward := hc.GetHeadersByNumberRange(tt.first, tt.last, false)
+		reverse := hc.GetHeadersByNumberRange(tt.first, tt.last, true)
+		if len(forward) != len(tt.want) || len(reverse) != len(tt.want) {
+			t.Fatalf("test %d: header count mismatch: have %d forward, %d reverse, want %d", i, len(forward), len(reverse), len(tt.want))
+		}
+		for j, want := range tt.want {
+			if forward[j].Hash() != want.Hash() {
+				t.Errorf("test %d: forward header %d mismatch: have %x, want %x", i, j, forward[j].Hash(), want.Hash())
+			}
+			if mirror := reverse[len(reverse)-1-j]; mirror.Hash() != want.Hash() {
+				t.Errorf("test %d: reverse header %d mismatch: have %x, want %x", i, j, mirror.Hash(), want.Hash())
+			}
+		}
+	}
+}
+
+func TestGetBodyRLPReader(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+	setTestCanonical(t, hc, canon)
+
+	r, err := hc.GetBodyRLPReader(canon[0].Hash())
+	if err != nil {
+		t.Fatalf("failed to open body reader: %v", err)
+	}
+	enc, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	body := new(types.Body)
+	if err := rlp.DecodeBytes(enc, body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	want, err := rlp.EncodeToBytes(hc.GetBody(canon[0].Hash()))
+	if err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+	if have, _ := rlp.EncodeToBytes(body); !bytes.Equal(have, want) {
+		t.Fatalf("body mismatch: have %x, want %x", have, want)
+	}
+	if _, err := hc.GetBodyRLPReader(common.Hash{0x01}); err != ErrBodyNotFound {
+		t.Fatalf("unknown body error mismatch: have %v, want %v", err, ErrBodyNotFound)
+	}
+}
+
+func TestGetBodyRLPFromBlock(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Only keep the block around in the cache, without its raw body
+	to := common.HexToAddress("0x1")
+	tx := types.NewTx(&types.InternalTx{ChainID: hc.config.ChainID, Nonce: 1, Gas: 21000, To: &to, Value: big.NewInt(1)})
+	block := types.NewBlockWithHeader(canon[0]).WithBody([]*types.Transaction{tx}, nil, nil, nil)
+	hc.bc.blockCache.Add(block.Hash(), block)
+	rawdb.DeleteBody(hc.headerDb, block.Hash(), block.NumberU64())
+
+	enc := hc.GetBodyRLP(block.Hash())
+	if enc == nil {
+		t.Fatalf("body missing despite known block")
+	}
+	body := new(types.Body)
+	if err := rlp.DecodeBytes(enc, body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if len(body.Transactions) != 1 || body.Transactions[0].Hash() != tx.Hash() {
+		t.Fatalf("body transactions mismatch: have %v, want [%x]", body.Transactions, tx.Hash())
+	}
+	if !hc.bc.bodyRLPCache.Contains(block.Hash()) {
+		t.Fatalf("encoded body not cached")
+	}
+}
+
+func TestHeadsGauge(t *testing.T) {
+	liveTestMetrics(t, &headsGauge)
+
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	fork := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+
+	tests := []struct {
+		header *types.Header
+		depth  int64
+	}{
+		{canon[0], 1},
+		{canon[1], 1}, // extends the tracked head
+		{fork[0], 2},  // opens a fork
+		{fork[1], 2},
+	}
+	for i, tt := range tests {
+		appendTestBlock(t, hc, tt.header)
+		if depth := headsGauge.Value(); depth != tt.depth {
+			t.Errorf("test %d: heads depth mismatch: have %d, want %d", i, depth, tt.depth)
+		}
+	}
+	// Reloading fewer persisted heads shrinks the depth
+	rawdb.WriteHeadsHashes(hc.headerDb, []common.Hash{canon[1].Hash()})
+	hc = reopenTestHeaderChain(t, hc)
+	if len(hc.heads) != 1 || hc.heads[0].Hash() != canon[1].Hash() {
+		t.Fatalf("heads mismatch after reload: have %v, want [%x]", hc.heads, canon[1].Hash())
+	}
+	if depth := headsGauge.Value(); depth != 1 {
+		t.Fatalf("heads depth mismatch after reload: have %d, want %d", depth, 1)
+	}
+}
+
+func TestForceCanonical(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon)
+	side := insertTestHeaders(hc, canon[0], 2, 1)
+
+	// Forcing below the head only rewrites the canonical mapping
+	if err := hc.ForceCanonical(side[0].Hash(), 2); err != nil {
+		t.Fatalf("failed to force canonical #2: %v", err)
+	}
+	if hash := hc.GetCanonicalHash(2); hash != side[0].Hash() {
+		t.Fatalf("canonical #2 mismatch: have %x, want %x", hash, side[0].Hash())
+	}
+	if head := hc.CurrentHeader(); head.Hash() != canon[2].Hash() {
+		t.Fatalf("current header moved: have %x, want %x", head.Hash(), canon[2].Hash())
+	}
+	// Forcing at the head number moves the head too
+	if err := hc.ForceCanonical(side[1].Hash(), 3); err != nil {
+		t.Fatalf("failed to force canonical #3: %v", err)
+	}
+	if head := hc.CurrentHeader(); head.Hash() != side[1].Hash() {
+		t.Fatalf("current header mismatch: have %x, want %x", head.Hash(), side[1].Hash())
+	}
+	if hash := rawdb.ReadHeadBlockHash(hc.headerDb); hash != side[1].Hash() {
+		t.Fatalf("persisted head mismatch: have %x, want %x", hash, side[1].Hash())
+	}
+	// Mismatched numbers and unknown hashes are refused
+	if err := hc.ForceCanonical(canon[1].Hash(), 3); err == nil {
+		t.Fatalf("forced canonical with mismatched number")
+	}
+	if err := hc.ForceCanonical(common.Hash{0x01}, 1); err == nil {
+		t.Fatalf("forced canonical with unknown hash")
+	}
+	if hash := hc.GetCanonicalHash(3); hash != side[1].Hash() {
+		t.Fatalf("refused force changed canonical #3: have %x, want %x", hash, side[1].Hash())
+	}
+}
+
+func TestSafeGetHeaderByHash(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	if header, err := hc.SafeGetHeaderByHash(canon[0].Hash()); err != nil || header.Hash() != canon[0].Hash() {
+		t.Fatalf("header mismatch: have %v (err %v), want %x", header, err, canon[0].Hash())
+	}
+	// Corrupt the cached header so reading it panics
+	hc.headerCache.Add(canon[1].Hash(), []byte{0xde, 0xad})
+	if header, err := hc.SafeGetHeaderByHash(canon[1].Hash()); err != ErrCorruptHeader || header != nil {
+		t.Fatalf("corrupt header result mismatch: have %v (err %v), want nil (err %v)", header, err, ErrCorruptHeader)
+	}
+}
+
+func TestGetReceiptsRLP(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+
+	receipts := types.Receipts{
+		{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000, Logs: []*types.Log{}},
+		{Status: types.ReceiptStatusFailed, CumulativeGasUsed: 42000, Logs: []*types.Log{{Data: []byte{0x01}}}},
+	}
+	rawdb.WriteReceipts(hc.headerDb, canon[0].Hash(), canon[0].NumberU64(), receipts)
+
+	enc := hc.GetReceiptsRLP(canon[0].Hash())
+	if enc == nil {
+		t.Fatalf("receipts not found")
+	}
+	var stored []*types.ReceiptForStorage
+	if err := rlp.DecodeBytes(enc, &stored); err != nil {
+		t.Fatalf("failed to decode receipts: %v", err)
+	}
+	want := rawdb.ReadRawReceipts(hc.headerDb, canon[0].Hash(), canon[0].NumberU64())
+	if len(stored) != len(want) {
+		t.Fatalf("receipt count mismatch: have %d, want %d", len(stored), len(want))
+	}
+	for i, receipt := range stored {
+		if receipt.Status != want[i].Status || receipt.CumulativeGasUsed != want[i].CumulativeGasUsed || len(receipt.Logs) != len(want[i].Logs) {
+			t.Errorf("receipt %d mismatch: have %+v, want %+v", i, receipt, want[i])
+		}
+	}
+	if enc := hc.GetReceiptsRLP(common.Hash{0x01}); enc != nil {
+		t.Fatalf("receipts found for unknown hash: %x", enc)
+	}
+}
+
+// countingDb wraps a database, counting the writes of the batches it creates.
+type countingDb struct {
+	ethdb.Database
+	writes int
+}
+
+func (db *countingDb) NewBatch() ethdb.Batch {
+	return &countingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+type countingBatch struct {
+	ethdb.Batch
+	db *countingDb
+}
+
+func (b *countingBatch) Write() error {
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+func TestPruneOrphansWriteBatchSize(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	setTestCanonical(t, hc, canon)
+	orphans := insertTestHeaders(hc, hc.genesisHeader, 5, 1)
+
+	db := &countingDb{Database: hc.headerDb}
+	hc.headerDb = db
+	hc.writeBatchSize = 2
+
+	pruned, err := hc.PruneOrphans(canon[5].NumberU64() + 1)
+	if err != nil {
+		t.Fatalf("failed to prune orphans: %v", err)
+	}
+	if pruned != len(orphans) {
+		t.Fatalf("pruned count mismatch: have %d, want %d", pruned, len(orphans))
+	}
+	// Two full batches are flushed along the way, the remainder at the end
+	if db.writes != 3 {
+		t.Fatalf("batch write count mismatch: have %d, want %d", db.writes, 3)
+	}
+	for _, header := range orphans {
+		if rawdb.ReadHeader(db, header.Hash(), header.NumberU64()) != nil {
+			t.Errorf("orphan #%d [%x] survived pruning", header.NumberU64(), header.Hash())
+		}
+	}
+}
+
+func TestGlobalCommonAncestor(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	if _, err := hc.GlobalCommonAncestor(); err == nil {
+		t.Fatalf("common ancestor found without heads")
+	}
+	base := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	// Grow three forks of different lengths off the shared base
+	for i := 1; i <= 3; i++ {
+		fork := insertTestHeaders(hc, base[1], i, uint64(i))
+		hc.addHead(fork[len(fork)-1])
+	}
+	ancestor, err := hc.GlobalCommonAncestor()
+	if err != nil {
+		t.Fatalf("failed to find common ancestor: %v", err)
+	}
+	if ancestor.Hash() != base[1].Hash() {
+		t.Fatalf("common ancestor mismatch: have #%d [%x], want #%d [%x]", ancestor.NumberU64(), ancestor.Hash(), base[1].NumberU64(), base[1].Hash())
+	}
+	// A fork diverging right at the genesis pulls the ancestor down to it
+	fork := insertTestHeaders(hc, hc.genesisHeader, 4, 4)
+	hc.addHead(fork[3])
+	if ancestor, err = hc.GlobalCommonAncestor(); err != nil {
+		t.Fatalf("failed to find common ancestor: %v", err)
+	}
+	if ancestor.Hash() != hc.genesisHeader.Hash() {
+		t.Fatalf("common ancestor mismatch: have #%d [%x], want genesis", ancestor.NumberU64(), ancestor.Hash())
+	}
+}
+
+func TestAppendReplayWindow(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	head := types.CopyHeader(hc.genesisHeader)
+	head.SetNumber(big.NewInt(2 * maxReorgDepth))
+	hc.currentHeader.Store(head)
+
+	tests := []struct {
+		number uint64
+		err    error
+	}{
+		{maxReorgDepth, nil},
+		{maxReorgDepth - 1, ErrBlockTooOld},
+		{1, ErrBlockTooOld},
+	}
+	for i, tt := range tests {
+		parent := types.CopyHeader(hc.genesisHeader)
+		parent.SetNumber(new(big.Int).SetUint64(tt.number - 1))
+		rawdb.WriteHeader(hc.headerDb, parent)
+
+		header := types.CopyHeader(hc.genesisHeader)
+		header.SetParentHash(parent.Hash())
+		header.SetNumber(new(big.Int).SetUint64(tt.number))
+		header.SetLocation(common.Location{0, 0})
+
+		if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(header), nil); err != tt.err {
+			t.Errorf("test %d: append error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestStrictHeaderCache(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	header := canon[1]
+
+	// Cache a header claiming a different number under the real hash
+	drifted := types.CopyHeader(canon[2])
+	hc.headerCache.Add(header.Hash(), drifted)
+
+	if cached := hc.GetHeader(header.Hash(), header.NumberU64()); cached != drifted {
+		t.Fatalf("lenient lookup bypassed the cache")
+	}
+	hc.SetStrictHeaderCache(true)
+	if fixed := hc.GetHeader(header.Hash(), header.NumberU64()); fixed == nil || fixed.Hash() != header.Hash() {
+		t.Fatalf("strict lookup mismatch: have %v, want %x", fixed, header.Hash())
+	}
+	if cached, _ := hc.headerCache.Get(header.Hash()); cached.(*types.Header).NumberU64() != header.NumberU64() {
+		t.Fatalf("drifted cache entry not replaced")
+	}
+}
+
+func TestAppendVerified(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{verifyErr: errors.New("verification invoked")}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[0]), nil); err == nil {
+		t.Fatalf("append skipped verification")
+	}
+	if err := hc.AppendVerified(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[0]), nil); err != nil {
+		t.Fatalf("failed to append verified block: %v", err)
+	}
+	// The parent must still be known at the preceding number
+	orphan := types.CopyHeader(canon[1])
+	orphan.SetParentHash(common.Hash{0x01})
+	if err := hc.AppendVerified(hc.headerDb.NewBatch(), types.NewBlockWithHeader(orphan), nil); err != consensus.ErrUnknownAncestor {
+		t.Fatalf("orphan append error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+	gap := types.CopyHeader(canon[1])
+	gap.SetNumber(big.NewInt(3))
+	if err := hc.AppendVerified(hc.headerDb.NewBatch(), types.NewBlockWithHeader(gap), nil); err != consensus.ErrUnknownAncestor {
+		t.Fatalf("non-contiguous append error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+	// A cached parent must not let a block skip numbers either
+	hc.GetHeaderByHash(canon[0].Hash())
+	if !hc.HasHeader(canon[0].Hash(), gap.NumberU64()-1) {
+		t.Fatalf("parent not served from the cache")
+	}
+	if err := hc.AppendVerified(hc.headerDb.NewBatch(), types.NewBlockWithHeader(gap), nil); err != consensus.ErrInvalidNumber {
+		t.Fatalf("skipped number append error mismatch: have %v, want %v", err, consensus.ErrInvalidNumber)
+	}
+	if err := hc.AppendVerified(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[1]), nil); err != nil {
+		t.Fatalf("failed to append verified child: %v", err)
+	}
+}
+
+func TestGetBlockByNumberCache(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon)
+
+	if block := hc.GetBlockByNumber(3); block == nil || block.Hash() != canon[2].Hash() {
+		t.Fatalf("block #3 mismatch: have %v, want %x", block, canon[2].Hash())
+	}
+	// A repeated fetch must not touch the database
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb, hc.bc.db = db, db
+	hc.bc.blockCache.Purge()
+
+	if block := hc.GetBlockByNumber(3); block == nil || block.Hash() != canon[2].Hash() {
+		t.Fatalf("cached block #3 mismatch: have %v, want %x", block, canon[2].Hash())
+	}
+	if len(db.keys) != 0 {
+		t.Fatalf("cached block fetch read the database %d times", len(db.keys))
+	}
+	// Reorging to a competing branch invalidates the cached block
+	side := insertTestHeaders(hc, canon[0], 2, 1)
+	if err := hc.SetCurrentHeader(side[1]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if block := hc.GetBlockByNumber(3); block == nil || block.Hash() != side[1].Hash() {
+		t.Fatalf("block #3 after reorg mismatch: have %v, want %x", block, side[1].Hash())
+	}
+}
+
+func TestHeadsChangeEvent(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	fork := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+
+	events := make(chan HeadsChangeEvent, 10)
+	sub := hc.SubscribeHeadsChangeEvent(events)
+	defer sub.Unsubscribe()
+
+	expectHeads := func(want ...*types.Header) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			// Compare the heads regardless of their order
+			heads := make(map[common.Hash]bool, len(ev.Heads))
+			for _, hash := range ev.Heads {
+				heads[hash] = true
+			}
+			if len(heads) != len(want) {
+				t.Fatalf("heads count mismatch: have %d, want %d", len(heads), len(want))
+			}
+			for _, head := range want {
+				if !heads[head.Hash()] {
+					t.Fatalf("head #%d [%x] missing", head.NumberU64(), head.Hash())
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no heads change event")
+		}
+	}
+	// Without throttling every change is posted, but re-appends are not
+	hc.headsChangeInterval = 0
+	appendTestBlock(t, hc, canon[0])
+	expectHeads(canon[0])
+	appendTestBlock(t, hc, fork[0])
+	expectHeads(canon[0], fork[0])
+	appendTestBlock(t, hc, fork[0])
+	select {
+	case ev := <-events:
+		t.Fatalf("heads change posted for unchanged heads: %v", ev.Heads)
+	default:
+	}
+	// Rapid changes are coalesced, the final heads posted once the interval elapses
+	hc.headsChangeInterval = 50 * time.Millisecond
+	appendTestBlock(t, hc, canon[1])
+	appendTestBlock(t, hc, fork[1])
+	expectHeads(canon[1], fork[1])
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected heads change event: %v", ev.Heads)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Stopping the chain cancels a scheduled event. Stop closes the tracked
+	// subscriptions, so watch the feed directly.
+	feedEvents := make(chan HeadsChangeEvent, 1)
+	feedSub := hc.headsChangeFeed.Subscribe(feedEvents)
+	defer feedSub.Unsubscribe()
+
+	hc.headsChangeSent = time.Now()
+	hc.addHead(canon[0])
+	hc.notifyHeadsChange()
+
+	stopped := make(chan struct{})
+	go func() {
+		hc.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("stop blocked on the scheduled heads change event")
+	}
+	select {
+	case ev := <-feedEvents:
+		t.Fatalf("heads change posted after stop: %v", ev.Heads)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNextBaseFee(t *testing.T) {
+	hc := newTestHeaderChain(t)
+
+	head := types.CopyHeader(hc.genesisHeader)
+	head.SetBaseFee(big.NewInt(params.GWei / 2))
+	head.SetGasLimit(10_000_000)
+	head.SetGasUsed(8_000_000)
+	hc.currentHeader.Store(head)
+
+	fee, err := hc.NextBaseFee()
+	if err != nil {
+		t.Fatalf("failed to compute next base fee: %v", err)
+	}
+	if want := misc.CalcBaseFee(hc.Config(), head); fee.Cmp(want) != 0 {
+		t.Fatalf("next base fee mismatch: have %v, want %v", fee, want)
+	}
+	if fee.Cmp(head.BaseFee()) <= 0 {
+		t.Fatalf("next base fee %v not above %v for a busy head", fee, head.BaseFee())
+	}
+	// A head without gas target cannot price its child
+	head = types.CopyHeader(head)
+	head.SetGasLimit(0)
+	hc.currentHeader.Store(head)
+	if _, err := hc.NextBaseFee(); err == nil {
+		t.Fatalf("next base fee computed without gas target")
+	}
+}
+
+// slowDb wraps a database, delaying every lookup.
+type slowDb struct {
+	ethdb.Database
+	delay time.Duration
+}
+
+func (db *slowDb) Get(key []byte) ([]byte, error) {
+	time.Sleep(db.delay)
+	return db.Database.Get(key)
+}
+
+func TestStopBackgroundRoutines(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 200, 0)
+	hashes := make([]common.Hash, len(canon))
+	for i, header := range canon {
+		hashes[i] = header.Hash()
+	}
+	slow := &slowDb{Database: hc.headerDb, delay: 5 * time.Millisecond}
+	hc.headerDb = slow
+
+	done := hc.PrefetchHeaders(hashes)
+	headers := hc.StreamHeaders(hashes) // never drained
+
+	stopped := make(chan struct{})
+	go func() {
+		hc.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stop blocked on background routines")
+	}
+	// Stop waits for the routines, so both must have wound down by now
+	select {
+	case <-done:
+	default:
+		t.Fatalf("prefetch still running after stop")
+	}
+	for range headers {
+	}
+	if cached := hc.headerCache.Len(); cached == len(canon) {
+		t.Fatalf("prefetch ran to completion instead of stopping")
+	}
+}
+
+func TestHeaderByNumber(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Leave a canonical mapping dangling at #3
+	rawdb.WriteCanonicalHash(hc.headerDb, common.Hash{0x01}, 3)
+
+	tests := []struct {
+		number uint64
+		hash   common.Hash
+		err    error
+	}{
+		{2, canon[1].Hash(), nil},
+		{3, common.Hash{}, ErrHeaderNotFound},
+		{4, common.Hash{}, ErrNoCanonicalHash},
+	}
+	for i, tt := range tests {
+		header, err := hc.HeaderByNumber(tt.number)
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if (header == nil) != (tt.err != nil) || (header != nil && header.Hash() != tt.hash) {
+			t.Errorf("test %d: header mismatch: have %v, want %x", i, header, tt.hash)
+		}
+	}
+}
+
+func TestAppendStrictTimestamps(t *testing.T) {
+	liveTestMetrics(t, &appendRejectNonMonotonicCounter)
+
+	tests := []struct {
+		strict bool
+		delta  int64
+		err    error
+	}{
+		{true, 1, nil},
+		{true, 0, ErrNonMonotonicTime},
+		{true, -1, ErrNonMonotonicTime},
+		{false, 0, nil},
+		{false, -1, nil},
+	}
+	rejected := int64(0)
+	for i, tt := range tests {
+		hc := newTestHeaderChain(t)
+		hc.engine = testEngine{}
+		hc.strictTimestamps = tt.strict
+		parent := insertTestHeaders(hc, hc.genesisHeader, 1, 0)[0]
+
+		header := insertTestHeaders(hc, parent, 1, 0)[0]
+		header.SetTime(uint64(int64(parent.Time()) + tt.delta))
+		if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(header), nil); err != tt.err {
+			t.Errorf("test %d: append error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if tt.err != nil {
+			rejected++
+		}
+		if have := appendRejectNonMonotonicCounter.Count(); have != rejected {
+			t.Errorf("test %d: reject counter mismatch: have %d, want %d", i, have, rejected)
+		}
+	}
+}
+
+func TestGetAncestorHeader(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	setTestCanonical(t, hc, canon)
+	side := insertTestHeaders(hc, canon[1], 4, 1)
+
+	for _, tip := range []*types.Header{canon[5], side[3]} {
+		for ancestor := uint64(0); ancestor <= tip.NumberU64(); ancestor++ {
+			header, err := hc.GetAncestorHeader(tip.Hash(), tip.NumberU64(), ancestor)
+			if err != nil {
+				t.Fatalf("failed to get ancestor %d of #%d: %v", ancestor, tip.NumberU64(), err)
+			}
+			maxNonCanonical := uint64(100)
+			hash, number := hc.GetAncestor(tip.Hash(), tip.NumberU64(), ancestor, &maxNonCanonical)
+			if want := hc.GetHeader(hash, number); header.Hash() != want.Hash() {
+				t.Fatalf("ancestor %d of #%d mismatch: have %x, want %x", ancestor, tip.NumberU64(), header.Hash(), want.Hash())
+			}
+		}
+	}
+	if _, err := hc.GetAncestorHeader(canon[5].Hash(), canon[5].NumberU64(), canon[5].NumberU64()+1); err == nil {
+		t.Fatalf("ancestor found beyond genesis")
+	}
+}
+
+func TestHeadsOrderDeterministic(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	// Grow three branches in lockstep so their heads keep sharing a number
+	forks := make([][]*types.Header, 3)
+	for i := range forks {
+		forks[i] = insertTestHeaders(hc, hc.genesisHeader, 3, uint64(i))
+	}
+	for n := 0; n < 3; n++ {
+		for _, i := range []int{2, 0, 1} {
+			appendTestBlock(t, hc, forks[i][n])
+			for j := 1; j < len(hc.heads); j++ {
+				prev, next := hc.heads[j-1], hc.heads[j]
+				prevHash, nextHash := prev.Hash(), next.Hash()
+				if prev.NumberU64() > next.NumberU64() || (prev.NumberU64() == next.NumberU64() && bytes.Compare(prevHash[:], nextHash[:]) >= 0) {
+					t.Fatalf("heads out of order: #%d [%x] before #%d [%x]", prev.NumberU64(), prevHash, next.NumberU64(), nextHash)
+				}
+			}
+		}
+	}
+	if len(hc.heads) != len(forks) {
+		t.Fatalf("head count mismatch: have %d, want %d", len(hc.heads), len(forks))
+	}
+}
+
+func TestForkBase(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+	side := insertTestHeaders(hc, canon[1], 3, 1)
+
+	hc.addHead(canon[4])
+	hc.addHead(side[2])
+
+	tests := []struct {
+		head *types.Header
+		base *types.Header
+	}{
+		{side[2], canon[1]},
+		{canon[4], canon[4]},
+	}
+	for i, tt := range tests {
+		hash, number, err := hc.ForkBase(tt.head.Hash())
+		if err != nil {
+			t.Fatalf("test %d: failed to find fork base: %v", i, err)
+		}
+		if hash != tt.base.Hash() || number != tt.base.NumberU64() {
+			t.Errorf("test %d: fork base mismatch: have #%d [%x], want #%d [%x]", i, number, hash, tt.base.NumberU64(), tt.base.Hash())
+		}
+	}
+	if _, _, err := hc.ForkBase(side[1].Hash()); err == nil {
+		t.Fatalf("fork base found for untracked head")
+	}
+}
+
+func TestCanonicalCursor(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 5, 0)
+	setTestCanonical(t, hc, canon)
+
+	cursor := hc.NewCanonicalCursor(2)
+	for _, want := range canon[1:] {
+		header, ok := cursor.Next()
+		if !ok {
+			t.Fatalf("cursor ended before #%d", want.NumberU64())
+		}
+		if header.Hash() != want.Hash() {
+			t.Fatalf("header #%d mismatch: have %x, want %x", want.NumberU64(), header.Hash(), want.Hash())
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if header, ok := cursor.Next(); ok || header != nil {
+			t.Fatalf("cursor moved past the head: %v", header)
+		}
+	}
+	if _, ok := hc.NewCanonicalCursor(6).Next(); ok {
+		t.Fatalf("cursor started above the head")
+	}
+}
+
+func TestGetBlockAndReceipts(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[0]), nil); err != nil {
+		t.Fatalf("failed to append block: %v", err)
+	}
+	rawdb.WriteReceipts(hc.headerDb, canon[0].Hash(), canon[0].NumberU64(), types.Receipts{})
+
+	block, receipts, err := hc.GetBlockAndReceipts(canon[0].Hash())
+	if err != nil {
+		t.Fatalf("failed to get block and receipts: %v", err)
+	}
+	if block.Hash() != canon[0].Hash() {
+		t.Fatalf("block mismatch: have %x, want %x", block.Hash(), canon[0].Hash())
+	}
+	if receipts == nil || len(receipts) != len(block.Transactions()) {
+		t.Fatalf("receipts mismatch: have %v, want %d receipts", receipts, len(block.Transactions()))
+	}
+	if _, _, err := hc.GetBlockAndReceipts(common.Hash{0x01}); err == nil {
+		t.Fatalf("unknown block found")
+	}
+}
+
+func TestReorgMeters(t *testing.T) {
+	meters := []*metrics.Meter{&blockReorgMeter, &blockReorgAddMeter, &blockReorgDropMeter}
+	for _, meter := range meters {
+		liveTestMetrics(t, meter)
+	}
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	side := insertTestHeaders(hc, canon[0], 4, 1)
+
+	// Neither extending the head nor jumping ahead along its branch is a reorg
+	setTestCanonical(t, hc, canon[:2])
+	if err := hc.SetCurrentHeader(canon[3]); err != nil {
+		t.Fatalf("failed to advance head: %v", err)
+	}
+	if count := blockReorgMeter.Count(); count != 0 {
+		t.Fatalf("reorg meter bumped by head extension: %d", count)
+	}
+	// Switching to the competing branch is one, dropping and adding its blocks
+	if err := hc.SetCurrentHeader(side[3]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	for i, want := range []int64{1, 4, 3} {
+		if count := (*meters[i]).Count(); count != want {
+			t.Errorf("meter %d count mismatch: have %d, want %d", i, count, want)
+		}
+	}
+}
+
+func TestRecentHeaders(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	setTestCanonical(t, hc, canon)
+	chain := append([]*types.Header{hc.genesisHeader}, canon...)
+
+	tests := []struct {
+		n    int
+		want []*types.Header
+	}{
+		{2, chain[3:]},
+		{5, chain},
+		{10, chain},
+		{math.MaxInt, chain},
+		{0, nil},
+		{-1, nil},
+	}
+	for i, tt := range tests {
+		headers := hc.RecentHeaders(tt.n)
+		if len(headers) != len(tt.want) {
+			t.Fatalf("test %d: header count mismatch: have %d, want %d", i, len(headers), len(tt.want))
+		}
+		for j, want := range tt.want {
+			if headers[j].Hash() != want.Hash() {
+				t.Errorf("test %d: header %d mismatch: have %x, want %x", i, j, headers[j].Hash(), want.Hash())
+			}
+		}
+	}
+}
+
+func TestReorgTxLookups(t *testing.T) {
+	// Only zones index transactions
+	defer func(location common.Location) { common.NodeLocation = location }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	hc := newTestHeaderChain(t)
+	receiptsCache, _ := lru.New(receiptsCacheLimit)
+	txLookupCache, _ := lru.New(txLookupCacheLimit)
+	hc.bc.processor = &StateProcessor{config: hc.config, hc: hc, receiptsCache: receiptsCache, txLookupCache: txLookupCache}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, canon[0], 2, 1)
+
+	// Give one block on each branch a transaction with its receipt
+	to := common.HexToAddress("0x1")
+	oldTx := types.NewTx(&types.InternalTx{ChainID: hc.config.ChainID, Nonce: 1, Gas: 21000, To: &to, Value: big.NewInt(1)})
+	newTx := types.NewTx(&types.InternalTx{ChainID: hc.config.ChainID, Nonce: 2, Gas: 21000, To: &to, Value: big.NewInt(2)})
+	for _, entry := range []struct {
+		header *types.Header
+		tx     *types.Transaction
+	}{{canon[1], oldTx}, {side[1], newTx}} {
+		block := types.NewBlockWithHeader(entry.header).WithBody(types.Transactions{entry.tx}, nil, nil, nil)
+		rawdb.WriteBody(hc.headerDb, block.Hash(), block.NumberU64(), block.Body())
+		rawdb.WriteReceipts(hc.headerDb, block.Hash(), block.NumberU64(), types.Receipts{{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000, Logs: []*types.Log{}}})
+	}
+	setTestCanonical(t, hc, canon)
+	rawdb.WriteTxLookupEntriesByBlock(hc.headerDb, hc.GetBlock(canon[1].Hash(), canon[1].NumberU64()))
+
+	if receipt, hash, _, _ := rawdb.ReadReceipt(hc.headerDb, oldTx.Hash(), hc.config); receipt == nil || hash != canon[1].Hash() {
+		t.Fatalf("old receipt not indexed before reorg: %v in %x", receipt, hash)
+	}
+	// Resolve both transactions through the processor, caching the old lookup
+	if lookup := hc.bc.processor.GetTransactionLookup(oldTx.Hash()); lookup == nil || lookup.BlockHash != canon[1].Hash() {
+		t.Fatalf("old lookup mismatch before reorg: %v", lookup)
+	}
+	if lookup := hc.bc.processor.GetTransactionLookup(newTx.Hash()); lookup != nil {
+		t.Fatalf("new transaction resolvable before reorg: %v", lookup)
+	}
+	setTestCanonical(t, hc, side[1:])
+
+	if lookup := hc.bc.processor.GetTransactionLookup(oldTx.Hash()); lookup != nil {
+		t.Fatalf("dropped lookup served from the cache: %v", lookup)
+	}
+	lookup := hc.bc.processor.GetTransactionLookup(newTx.Hash())
+	if lookup == nil || lookup.BlockHash != side[1].Hash() {
+		t.Fatalf("new lookup mismatch after reorg: %v", lookup)
+	}
+	if receipts := hc.bc.processor.GetReceiptsByHash(lookup.BlockHash); uint64(len(receipts)) <= lookup.Index {
+		t.Fatalf("new receipt not resolvable through its lookup: %v", receipts)
+	}
+
+	if entry := rawdb.ReadTxLookupEntry(hc.headerDb, oldTx.Hash()); entry != nil {
+		t.Fatalf("dropped transaction still indexed at #%d", *entry)
+	}
+	if receipt, _, _, _ := rawdb.ReadReceipt(hc.headerDb, oldTx.Hash(), hc.config); receipt != nil {
+		t.Fatalf("dropped receipt still resolvable")
+	}
+	if receipt, hash, _, _ := rawdb.ReadReceipt(hc.headerDb, newTx.Hash(), hc.config); receipt == nil || hash != side[1].Hash() {
+		t.Fatalf("new receipt not indexed after reorg: %v in %x", receipt, hash)
+	}
+}
+
+// flakyDb fails the given number of reads before passing them through.
+type flakyDb struct {
+	ethdb.Database
+	failures int
+}
+
+var errFlakyRead = errors.New("transient read failure")
+
+func (db *flakyDb) Has(key []byte) (bool, error) {
+	if db.failures > 0 {
+		db.failures--
+		return false, errFlakyRead
+	}
+	return db.Database.Has(key)
+}
+
+func (db *flakyDb) Get(key []byte) ([]byte, error) {
+	if db.failures > 0 {
+		db.failures--
+		return nil, errFlakyRead
+	}
+	return db.Database.Get(key)
+}
+
+func TestGetHeaderE(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+	db := &flakyDb{Database: hc.headerDb}
+	hc.headerDb = db
+
+	// A read failing past the retries surfaces, where GetHeader reports nothing
+	db.failures = dbReadRetries
+	if header, err := hc.GetHeaderE(canon[0].Hash(), 1); err != errFlakyRead || header != nil {
+		t.Fatalf("failing read mismatch: have %v (err %v), want nil (err %v)", header, err, errFlakyRead)
+	}
+	db.failures = dbReadRetries
+	if number, err := hc.GetBlockNumberE(canon[0].Hash()); err != errFlakyRead || number != nil {
+		t.Fatalf("failing number read mismatch: have %v (err %v), want nil (err %v)", number, err, errFlakyRead)
+	}
+	// A transient failure is retried
+	db.failures = dbReadRetries - 1
+	if header, err := hc.GetHeaderE(canon[0].Hash(), 1); err != nil || header.Hash() != canon[0].Hash() {
+		t.Fatalf("retried read mismatch: have %v (err %v), want %x", header, err, canon[0].Hash())
+	}
+	db.failures = dbReadRetries - 1
+	if number, err := hc.GetBlockNumberE(canon[0].Hash()); err != nil || *number != 1 {
+		t.Fatalf("retried number read mismatch: have %v (err %v), want 1", number, err)
+	}
+	// A missing header is told apart from a failing read
+	if _, err := hc.GetHeaderE(common.Hash{0x01}, 1); err != ErrHeaderNotFound {
+		t.Fatalf("missing header error mismatch: have %v, want %v", err, ErrHeaderNotFound)
+	}
+	if _, err := hc.GetBlockNumberE(common.Hash{0x01}); err != ErrHeaderNotFound {
+		t.Fatalf("missing number error mismatch: have %v, want %v", err, ErrHeaderNotFound)
+	}
+}
+
+func TestVerifySeal(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{verifyErr: errors.New("header verification")}
+
+	// Only the seal is checked, so an orphan with a valid seal passes
+	orphan := types.EmptyHeader()
+	orphan.SetParentHash(common.Hash{0x01})
+	orphan.SetNumber(big.NewInt(10))
+	if err := hc.VerifySeal(orphan); err != nil {
+		t.Fatalf("valid seal rejected: %v", err)
+	}
+	errSeal := errors.New("invalid seal")
+	hc.engine = testEngine{sealErr: errSeal}
+	if err := hc.VerifySeal(orphan); err != errSeal {
+		t.Fatalf("invalid seal error mismatch: have %v, want %v", err, errSeal)
+	}
+}
+
+func TestProtectedHashes(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	side := insertTestHeaders(hc, canon[0], 4, 1)
+	late := insertTestHeaders(hc, canon[2], 2, 2)
+	setTestCanonical(t, hc, canon)
+
+	// A reorg forking below the protected header is refused outright
+	hc.protectedHashes = map[common.Hash]bool{canon[2].Hash(): true}
+	if err := hc.SetCurrentHeader(side[3]); err != ErrProtectedHeader {
+		t.Fatalf("reorg past protected header error mismatch: have %v, want %v", err, ErrProtectedHeader)
+	}
+	if head := hc.CurrentHeader(); head.Hash() != canon[3].Hash() {
+		t.Fatalf("head moved by refused reorg: have %x, want %x", head.Hash(), canon[3].Hash())
+	}
+	for _, header := range canon {
+		if hash := rawdb.ReadCanonicalHash(hc.headerDb, header.NumberU64()); hash != header.Hash() {
+			t.Fatalf("canonical hash #%d changed by refused reorg: have %x, want %x", header.NumberU64(), hash, header.Hash())
+		}
+	}
+	// One forking above it goes through
+	if err := hc.SetCurrentHeader(late[1]); err != nil {
+		t.Fatalf("reorg above protected header failed: %v", err)
+	}
+	if hash := rawdb.ReadCanonicalHash(hc.headerDb, canon[2].NumberU64()); hash != canon[2].Hash() {
+		t.Fatalf("protected header dropped: have %x, want %x", hash, canon[2].Hash())
+	}
+}
+
+func TestGetBlockHashesUntil(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	side := insertTestHeaders(hc, canon[0], 2, 1)
+	tip := canon[len(canon)-1]
+
+	tests := []struct {
+		stop common.Hash
+		max  uint64
+		want []*types.Header
+	}{
+		// Stop hash reached before max
+		{canon[2].Hash(), 10, []*types.Header{canon[4], canon[3]}},
+		// Max hit before the stop hash
+		{canon[0].Hash(), 2, []*types.Header{canon[4], canon[3]}},
+		// Stop hash off the branch, walking to max or genesis
+		{side[1].Hash(), 3, []*types.Header{canon[4], canon[3], canon[2]}},
+		{side[1].Hash(), 10, []*types.Header{canon[4], canon[3], canon[2], canon[1], canon[0], hc.genesisHeader}},
+	}
+	for i, tt := range tests {
+		hashes := hc.GetBlockHashesUntil(tip.Hash(), tt.stop, tt.max)
+		if len(hashes) != len(tt.want) {
+			t.Fatalf("test %d: hash count mismatch: have %d, want %d", i, len(hashes), len(tt.want))
+		}
+		for j, want := range tt.want {
+			if hashes[j] != want.Hash() {
+				t.Errorf("test %d: hash %d mismatch: have %x, want %x", i, j, hashes[j], want.Hash())
+			}
+		}
+	}
+}
+
+// failingDb hands out batches whose commit fails.
+type failingDb struct {
+	ethdb.Database
+}
+
+var errBatchWrite = errors.New("batch write failure")
+
+func (db *failingDb) NewBatch() ethdb.Batch {
+	return &failingBatch{Batch: db.Database.NewBatch()}
+}
+
+type failingBatch struct {
+	ethdb.Batch
+}
+
+func (b *failingBatch) Write() error {
+	return errBatchWrite
+}
+
+func TestFlushHeads(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, canon[0], 1, 1)
+	hc.heads = []*types.Header{side[0], canon[1]}
+	hc.currentHeader.Store(canon[1])
+
+	// A failing commit leaves neither the heads nor the head persisted
+	db := hc.headerDb
+	hc.headerDb = &failingDb{Database: db}
+	if err := hc.FlushHeads(); err != errBatchWrite {
+		t.Fatalf("failed flush error mismatch: have %v, want %v", err, errBatchWrite)
+	}
+	if heads := rawdb.ReadHeadsHashes(db); len(heads) != 0 {
+		t.Fatalf("heads persisted by failed flush: %x", heads)
+	}
+	if head := rawdb.ReadHeadBlockHash(db); head != hc.genesisHeader.Hash() {
+		t.Fatalf("head persisted by failed flush: have %x, want %x", head, hc.genesisHeader.Hash())
+	}
+	// A successful one persists both
+	hc.headerDb = db
+	if err := hc.FlushHeads(); err != nil {
+		t.Fatalf("failed to flush heads: %v", err)
+	}
+	if heads := rawdb.ReadHeadsHashes(db); len(heads) != 2 || heads[0] != side[0].Hash() || heads[1] != canon[1].Hash() {
+		t.Fatalf("persisted heads mismatch: have %x", heads)
+	}
+	if head := rawdb.ReadHeadBlockHash(db); head != canon[1].Hash() {
+		t.Fatalf("persisted head mismatch: have %x, want %x", head, canon[1].Hash())
+	}
+}
+
+func TestExportForkTree(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	early := insertTestHeaders(hc, canon[0], 2, 1)
+	late := insertTestHeaders(hc, canon[2], 1, 2)
+	setTestCanonical(t, hc, canon)
+	hc.heads = []*types.Header{early[1], late[0], canon[3]}
+
+	var buf bytes.Buffer
+	if err := hc.ExportForkTree(&buf); err != nil {
+		t.Fatalf("failed to export fork tree: %v", err)
+	}
+	var tree forkTree
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatalf("failed to decode fork tree: %v", err)
+	}
+	wantForks := map[common.Hash]*types.Header{
+		early[1].Hash(): canon[0],
+		late[0].Hash():  canon[2],
+		canon[3].Hash(): canon[3],
+	}
+	if len(tree.Heads) != len(wantForks) {
+		t.Fatalf("head count mismatch: have %d, want %d", len(tree.Heads), len(wantForks))
+	}
+	for _, head := range tree.Heads {
+		want, ok := wantForks[head.Hash]
+		if !ok {
+			t.Fatalf("unexpected head %x", head.Hash)
+		}
+		if head.ForkPoint.Hash != want.Hash() || head.ForkPoint.Number != want.NumberU64() {
+			t.Errorf("head %x fork point mismatch: have %x #%d, want %x #%d", head.Hash, head.ForkPoint.Hash, head.ForkPoint.Number, want.Hash(), want.NumberU64())
+		}
+	}
+	// The canonical chain is listed from the lowest fork point up
+	if len(tree.Canonical) != len(canon) {
+		t.Fatalf("canonical length mismatch: have %d, want %d", len(tree.Canonical), len(canon))
+	}
+	for i, node := range tree.Canonical {
+		if node.Hash != canon[i].Hash() || node.Number != canon[i].NumberU64() {
+			t.Errorf("canonical node %d mismatch: have %x #%d, want %x #%d", i, node.Hash, node.Number, canon[i].Hash(), canon[i].NumberU64())
+		}
+	}
+}
+
+func TestResetHeads(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, canon[0], 1, 1)
+	setTestCanonical(t, hc, canon)
+	hc.heads = []*types.Header{side[0], canon[1]}
+	if err := hc.FlushHeads(); err != nil {
+		t.Fatalf("failed to flush heads: %v", err)
+	}
+	// A failing write is reported and leaves the heads untouched
+	db := hc.headerDb
+	hc.headerDb = &failingDb{Database: db}
+	if err := hc.resetHeads(hc.genesisHeader); err != errBatchWrite {
+		t.Fatalf("failed reset error mismatch: have %v, want %v", err, errBatchWrite)
+	}
+	if len(hc.heads) != 2 || hc.CurrentHeader().Hash() != canon[1].Hash() {
+		t.Fatalf("heads changed by failed reset: %v", hc.heads)
+	}
+	hc.headerDb = db
+	if err := hc.resetHeads(hc.genesisHeader); err != nil {
+		t.Fatalf("failed to reset heads: %v", err)
+	}
+	if len(hc.heads) != 0 {
+		t.Fatalf("heads kept in memory: %v", hc.heads)
+	}
+	// A chain restarted over the same database must not reload the old heads
+	restarted := newTestHeaderChain(t)
+	restarted.headerDb = hc.headerDb
+	if err := restarted.loadLastState(); err != nil {
+		t.Fatalf("failed to load last state: %v", err)
+	}
+	if len(restarted.heads) != 0 {
+		t.Fatalf("stale heads reloaded: %v", restarted.heads)
+	}
+	if head := restarted.CurrentHeader(); head == nil || head.Hash() != hc.genesisHeader.Hash() {
+		t.Fatalf("restarted head mismatch: have %v, want %x", head, hc.genesisHeader.Hash())
+	}
+}
+
+func TestGetHeaderNumbers(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	header := insertTestHeaders(hc, hc.genesisHeader, 1, 0)[0]
+	header.SetNumber(big.NewInt(7), common.PRIME_CTX)
+	header.SetNumber(big.NewInt(8), common.REGION_CTX)
+	header.SetNumber(big.NewInt(9), common.ZONE_CTX)
+	rawdb.WriteHeader(hc.headerDb, header)
+	rawdb.WriteTermini(hc.headerDb, header.Hash(), []common.Hash{hc.genesisHeader.Hash()})
+
+	numbers, err := hc.GetHeaderNumbers(header.Hash())
+	if err != nil {
+		t.Fatalf("failed to get header numbers: %v", err)
+	}
+	want := []uint64{7, 8, 9}
+	if len(numbers) != len(want) {
+		t.Fatalf("number count mismatch: have %d, want %d", len(numbers), len(want))
+	}
+	for ctx, number := range numbers {
+		if number != want[ctx] {
+			t.Errorf("context %d number mismatch: have %d, want %d", ctx, number, want[ctx])
+		}
+	}
+	if _, err := hc.GetHeaderNumbers(common.Hash{0x01}); err != ErrHeaderNotFound {
+		t.Fatalf("unknown hash error mismatch: have %v, want %v", err, ErrHeaderNotFound)
+	}
+}
+
+func TestAppendWaitsForParent(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	hc.parentWaitTimeout = 5 * time.Second
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+
+	// Forget the headers so both blocks have to be appended afresh
+	for _, header := range canon {
+		rawdb.DeleteHeader(hc.headerDb, header.Hash(), header.NumberU64())
+	}
+	hc.headerCache.Purge()
+	hc.numberCache.Purge()
+
+	// Append the child ahead of its parent, which is still in flight
+	errc := make(chan error, 1)
+	go func() {
+		batch := hc.headerDb.NewBatch()
+		if err := hc.Append(batch, types.NewBlockWithHeader(canon[1]), nil); err != nil {
+			errc <- err
+			return
+		}
+		errc <- batch.Write()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	batch := hc.headerDb.NewBatch()
+	if err := hc.Append(batch, types.NewBlockWithHeader(canon[0]), nil); err != nil {
+		t.Fatalf("failed to append parent: %v", err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("failed to write parent: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to append child: %v", err)
+	}
+	for _, header := range canon {
+		if !hc.HasHeader(header.Hash(), header.NumberU64()) {
+			t.Errorf("block #%d not appended", header.NumberU64())
+		}
+	}
+	// A parent which never arrives fails the append once the wait is over
+	hc.parentWaitTimeout = 50 * time.Millisecond
+	orphan := types.CopyHeader(canon[1])
+	orphan.SetParentHash(common.Hash{0x01})
+	start := time.Now()
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(orphan), nil); err != consensus.ErrUnknownAncestor {
+		t.Fatalf("orphan append error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+	if elapsed := time.Since(start); elapsed < hc.parentWaitTimeout {
+		t.Fatalf("orphan rejected before the wait was over: %v", elapsed)
+	}
+	// Without opting in, the append fails right away
+	hc = reopenTestHeaderChain(t, hc)
+	if hc.parentWaitTimeout != 0 {
+		t.Fatalf("parent wait enabled by default: %v", hc.parentWaitTimeout)
+	}
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(orphan), nil); err != consensus.ErrUnknownAncestor {
+		t.Fatalf("orphan append error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+func TestHighestCanonicalNumber(t *testing.T) {
+	for _, length := range []int{0, 1, 2, 3, 7, 8, 9, 100} {
+		hc := newTestHeaderChain(t)
+		setTestCanonical(t, hc, insertTestHeaders(hc, hc.genesisHeader, length, 0))
+
+		number, err := hc.HighestCanonicalNumber()
+		if err != nil {
+			t.Fatalf("length %d: failed to find highest canonical number: %v", length, err)
+		}
+		if number != uint64(length) {
+			t.Errorf("length %d: highest canonical number mismatch: have %d, want %d", length, number, length)
+		}
+	}
+}
+
+func TestVerifyHeaderAgainst(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+
+	// Neither header is stored, the parent is supplied explicitly
+	parent := types.EmptyHeader()
+	parent.SetNumber(big.NewInt(1))
+	parent.SetDifficulty(big.NewInt(100))
+	header := types.EmptyHeader()
+	header.SetParentHash(parent.Hash())
+	header.SetNumber(big.NewInt(2))
+	header.SetDifficulty(big.NewInt(100))
+
+	if err := hc.VerifyHeaderAgainst(header, parent); err != nil {
+		t.Fatalf("valid header rejected: %v", err)
+	}
+	parent.SetDifficulty(big.NewInt(200))
+	if err := hc.VerifyHeaderAgainst(header, parent); err == nil {
+		t.Fatalf("header with mismatching difficulty accepted")
+	}
+}
+
+func TestGetBodyWithNumber(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	side := insertTestHeaders(hc, canon[0], 1, 1)
+
+	// A stale number cache entry sends the lookup by hash astray
+	hc.numberCache.Add(side[0].Hash(), side[0].NumberU64()+1)
+	if body := hc.GetBody(side[0].Hash()); body != nil {
+		t.Fatalf("body found through stale number")
+	}
+	if body := hc.GetBodyWithNumber(side[0].Hash(), side[0].NumberU64()); body == nil {
+		t.Fatalf("side branch body not found with explicit number")
+	}
+	if body := hc.GetBodyWithNumber(common.Hash{0x01}, side[0].NumberU64()); body != nil {
+		t.Fatalf("body found for unknown hash")
+	}
+}
+
+func TestRepairNumberIndex(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 4, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Point two canonical hashes at wrong numbers
+	rawdb.WriteHeaderNumber(hc.headerDb, canon[1].Hash(), 7)
+	rawdb.DeleteHeaderNumber(hc.headerDb, canon[2].Hash())
+	hc.numberCache.Purge()
+
+	repaired, err := hc.RepairNumberIndex(0, canon[3].NumberU64()+2)
+	if err != nil {
+		t.Fatalf("failed to repair number index: %v", err)
+	}
+	if repaired != 2 {
+		t.Fatalf("repaired count mismatch: have %d, want %d", repaired, 2)
+	}
+	for _, header := range append([]*types.Header{hc.genesisHeader}, canon...) {
+		if number := hc.GetBlockNumber(header.Hash()); number == nil || *number != header.NumberU64() {
+			t.Errorf("number of %x mismatch: have %v, want %d", header.Hash(), number, header.NumberU64())
+		}
+	}
+	// A consistent index is left alone
+	if repaired, err := hc.RepairNumberIndex(0, canon[3].NumberU64()); err != nil || repaired != 0 {
+		t.Fatalf("consistent index repair mismatch: have %d (err %v), want 0", repaired, err)
+	}
+	if _, err := hc.RepairNumberIndex(2, 1); err == nil {
+		t.Fatalf("inverted range accepted")
+	}
+}
+
+func TestGetHeaderFromDB(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Cache a stale header under the hash of a canonical one
+	stale := types.CopyHeader(canon[1])
+	stale.SetParentHash(common.Hash{0x01})
+	hc.headerCache.Add(canon[1].Hash(), stale)
+
+	if header := hc.GetHeaderFromDB(canon[1].Hash(), canon[1].NumberU64()); header == nil || header.ParentHash() != canon[0].Hash() {
+		t.Fatalf("stored header mismatch: have %v, want parent %x", header, canon[0].Hash())
+	}
+	if err := hc.VerifyCanonicalChain(0, canon[2].NumberU64()); err != nil {
+		t.Fatalf("audit misled by stale cache: %v", err)
+	}
+	// Reads from the database leave the cache alone
+	hc.headerCache.Purge()
+	hc.GetHeaderFromDB(canon[2].Hash(), canon[2].NumberU64())
+	if hc.headerCache.Contains(canon[2].Hash()) {
+		t.Fatalf("header cached by database read")
+	}
+}
+
+func TestNewHeadEvent(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	side := insertTestHeaders(hc, canon[0], 3, 1)
+	setTestCanonical(t, hc, canon[:2])
+
+	events := make(chan NewHeadEvent, 1)
+	sub := hc.SubscribeNewHeadEvent(events)
+	defer sub.Unsubscribe()
+
+	check := func(head *types.Header, reorg bool, depth int) {
+		t.Helper()
+		if err := hc.SetCurrentHeader(head); err != nil {
+			t.Fatalf("failed to set head: %v", err)
+		}
+		select {
+		case ev := <-events:
+			if ev.Header.Hash() != head.Hash() || ev.Reorg != reorg || ev.Depth != depth {
+				t.Fatalf("event mismatch: have %x reorg %v depth %d, want %x reorg %v depth %d", ev.Header.Hash(), ev.Reorg, ev.Depth, head.Hash(), reorg, depth)
+			}
+		default:
+			t.Fatalf("no new head event delivered")
+		}
+	}
+	// Extending the canonical chain is no reorg
+	check(canon[2], false, 0)
+	// Switching to the competing branch drops the two blocks above the fork
+	check(side[2], true, 2)
+}
+
+func TestChildren(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	side := insertTestHeaders(hc, canon[0], 2, 1)
+	other := insertTestHeaders(hc, hc.genesisHeader, 2, 2)
+	setTestCanonical(t, hc, canon)
+
+	children := hc.Children(canon[0].Hash(), canon[0].NumberU64())
+	want := map[common.Hash]bool{canon[1].Hash(): true, side[0].Hash(): true}
+	if len(children) != len(want) {
+		t.Fatalf("child count mismatch: have %d, want %d", len(children), len(want))
+	}
+	for _, child := range children {
+		if !want[child.Hash()] {
+			t.Errorf("unexpected child #%d [%x]", child.NumberU64(), child.Hash())
+		}
+	}
+	// Headers at the same height under another parent are no children
+	if children := hc.Children(other[0].Hash(), other[0].NumberU64()); len(children) != 1 || children[0].Hash() != other[1].Hash() {
+		t.Fatalf("children of other branch mismatch: have %v, want [%x]", children, other[1].Hash())
+	}
+	if children := hc.Children(canon[2].Hash(), canon[2].NumberU64()); len(children) != 0 {
+		t.Fatalf("children found for tip: %v", children)
+	}
+}
+
+func TestAppendCurrentHeaderChild(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	setTestCanonical(t, hc, canon[:1])
+	hc.headerCache.Purge()
+	hc.numberCache.Purge()
+
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb = db
+	if err := hc.Append(db.NewBatch(), types.NewBlockWithHeader(canon[1]), nil); err != nil {
+		t.Fatalf("failed to append block: %v", err)
+	}
+	// Only the termini of the parent are looked up, never its header
+	parentKey := testHeaderKey(canon[0])
+	for _, key := range db.keys {
+		if bytes.Equal(key, parentKey) {
+			t.Errorf("parent header read from database")
+		}
+	}
+	// The current header is still unknown to GetHeader without its termini
+	rawdb.DeleteTermini(hc.headerDb, canon[0].Hash())
+	if header := hc.GetHeader(canon[0].Hash(), canon[0].NumberU64()); header != nil {
+		t.Fatalf("current header returned without termini")
+	}
+}
+
+func TestBlockByNumber(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 2, 0)
+	setTestCanonical(t, hc, canon)
+
+	// Lose the body of a canonical block, keeping its header
+	rawdb.DeleteBody(hc.headerDb, canon[1].Hash(), canon[1].NumberU64())
+
+	tests := []struct {
+		number uint64
+		hash   common.Hash
+		err    error
+	}{
+		{1, canon[0].Hash(), nil},
+		{2, common.Hash{}, ErrBodyNotFound},
+		{3, common.Hash{}, ErrNoCanonicalHash},
+	}
+	for i, tt := range tests {
+		block, err := hc.BlockByNumber(tt.number)
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err == nil && block.Hash() != tt.hash {
+			t.Errorf("test %d: block mismatch: have %x, want %x", i, block.Hash(), tt.hash)
+		}
+	}
+}
+
+func TestAppendVerifyTimeout(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{verifyDelay: 500 * time.Millisecond}
+	hc.verifyTimeout = 50 * time.Millisecond
+	canon := insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+
+	start := time.Now()
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[0]), nil); err != ErrVerifyTimeout {
+		t.Fatalf("append error mismatch: have %v, want %v", err, ErrVerifyTimeout)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("append waited for the engine: %v", elapsed)
+	}
+	// Verifications finishing in time are unaffected. A fresh chain is used as
+	// the abandoned verification above may still be reading the engine.
+	hc = newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	hc.verifyTimeout = 50 * time.Millisecond
+	canon = insertTestHeaders(hc, hc.genesisHeader, 1, 0)
+	if err := hc.Append(hc.headerDb.NewBatch(), types.NewBlockWithHeader(canon[0]), nil); err != nil {
+		t.Fatalf("failed to append block: %v", err)
+	}
+}
+
+func TestRecomputeHead(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	hc.engine = testEngine{}
+	light := insertTestHeaders(hc, hc.genesisHeader, 2, 1)
+	heavy := insertTestHeaders(hc, hc.genesisHeader, 2, 5)
+	setTestCanonical(t, hc, light)
+	hc.heads = []*types.Header{light[1], heavy[1]}
+
+	head, err := hc.RecomputeHead()
+	if err != nil {
+		t.Fatalf("failed to recompute head: %v", err)
+	}
+	if head.Hash() != heavy[1].Hash() || hc.CurrentHeader().Hash() != heavy[1].Hash() {
+		t.Fatalf("head mismatch: have %x (current %x), want %x", head.Hash(), hc.CurrentHeader().Hash(), heavy[1].Hash())
+	}
+	if hash := rawdb.ReadCanonicalHash(hc.headerDb, 1); hash != heavy[0].Hash() {
+		t.Fatalf("canonical hash mismatch: have %x, want %x", hash, heavy[0].Hash())
+	}
+	// The heaviest head staying current is left alone
+	if head, err := hc.RecomputeHead(); err != nil || head.Hash() != heavy[1].Hash() {
+		t.Fatalf("settled head mismatch: have %x (err %v), want %x", head.Hash(), err, heavy[1].Hash())
+	}
+}
+
+func TestWarmHeaderCache(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 6, 0)
+	setTestCanonical(t, hc, canon)
+	hc.headerCache.Purge()
+	hc.numberCache.Purge()
+
+	// Restart over the same database with warm-up enabled
+	hc.warmHeaders = 4
+	if err := hc.loadLastState(); err != nil {
+		t.Fatalf("failed to load last state: %v", err)
+	}
+	hc.wg.Wait()
+
+	db := &readRecordingDb{Database: hc.headerDb}
+	hc.headerDb = db
+	for i, header := range canon {
+		db.keys = nil
+		if hc.GetHeader(header.Hash(), header.NumberU64()) == nil {
+			t.Fatalf("header #%d not found", header.NumberU64())
+		}
+		read := false
+		for _, key := range db.keys {
+			read = read || bytes.Equal(key, testHeaderKey(header))
+		}
+		if want := i < len(canon)-hc.warmHeaders; read != want {
+			t.Errorf("header #%d database read mismatch: have %v, want %v", header.NumberU64(), read, want)
+		}
+	}
+}
+
+func TestCanonicalDigest(t *testing.T) {
+	hc := newTestHeaderChain(t)
+	canon := insertTestHeaders(hc, hc.genesisHeader, 3, 0)
+	side := insertTestHeaders(hc, canon[1], 1, 1)
+	setTestCanonical(t, hc, canon)
+
+	last := canon[2].NumberU64()
+	want, err := hc.CanonicalDigest(0, last)
+	if err != nil {
+		t.Fatalf("failed to digest canonical range: %v", err)
+	}
+	if have, err := hc.CanonicalDigest(0, last); err != nil || have != want {
+		t.Fatalf("digest not deterministic: have %x (%v), want %x", have, err, want)
+	}
+	// Replacing the last canonical header changes the digest
+	setTestCanonical(t, hc, append(canon[:2:2], side...))
+	if have, err := hc.CanonicalDigest(0, last); err != nil || have == want {
+		t.Fatalf("digest unchanged by differing header: have %x (%v)", have, err)
+	}
+	setTestCanonical(t, hc, canon)
+	if have, err := hc.CanonicalDigest(0, last); err != nil || have != want {
+		t.Fatalf("digest mismatch after restoring canon: have %x (%v), want %x", have, err, want)
+	}
+	if _, err := hc.CanonicalDigest(0, last+1); !errors.Is(err, ErrNoCanonicalHash) {
+		t.Fatalf("missing canonical hash error mismatch: have %v, want %v", err, ErrNoCanonicalHash)
+	}
+	if _, err := hc.CanonicalDigest(last, 0); err == nil {
+		t.Fatalf("inverted range accepted")
+	}
+}
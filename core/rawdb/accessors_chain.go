@@ -32,6 +32,16 @@ import (
 	"github.com/dominant-strategies/go-quai/rlp"
 )
 
+// readE retrieves the value stored under key, telling a missing key (nil, nil)
+// apart from a failing read, which the database's Get does not do.
+func readE(db ethdb.KeyValueReader, key []byte) ([]byte, error) {
+	has, err := db.Has(key)
+	if err != nil || !has {
+		return nil, err
+	}
+	return db.Get(key)
+}
+
 // ReadCanonicalHash retrieves the hash assigned to a canonical block number.
 func ReadCanonicalHash(db ethdb.Reader, number uint64) common.Hash {
 	data, _ := db.Get(headerHashKey(number))
@@ -116,6 +126,21 @@ func ReadHeaderNumber(db ethdb.KeyValueReader, hash common.Hash) *uint64 {
 	return &number
 }
 
+// ReadHeaderNumberE is like ReadHeaderNumber, but reports database failures
+// instead of treating them as a missing mapping. It returns nil, nil if the
+// hash is unknown.
+func ReadHeaderNumberE(db ethdb.KeyValueReader, hash common.Hash) (*uint64, error) {
+	data, err := readE(db, headerNumberKey(hash))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if len(data) != 8 {
+		return nil, errors.New("invalid header number length")
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number, nil
+}
+
 // WriteHeaderNumber stores the hash->number mapping.
 func WriteHeaderNumber(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
 	key := headerNumberKey(hash)
@@ -295,6 +320,32 @@ func ReadHeader(db ethdb.Reader, hash common.Hash, number uint64) *types.Header
 	return header
 }
 
+// ReadHeaderE is like ReadHeader, but reports database and decoding failures
+// instead of treating them as a missing header. It returns nil, nil if the
+// header is unknown.
+func ReadHeaderE(db ethdb.Reader, hash common.Hash, number uint64) (*types.Header, error) {
+	// Ancient lookups fail for anything not yet frozen, so only the key-value
+	// store can tell a missing header apart from a failing read
+	data, _ := db.Ancient(freezerHeaderTable, number)
+	if len(data) == 0 || crypto.Keccak256Hash(data) != hash {
+		var err error
+		if data, err = readE(db, headerKey(number, hash)); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		data, _ = db.Ancient(freezerHeaderTable, number)
+		if len(data) == 0 || crypto.Keccak256Hash(data) != hash {
+			return nil, nil
+		}
+	}
+	header := new(types.Header)
+	if err := rlp.Decode(bytes.NewReader(data), header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
 // WriteHeader stores a block header into the database and also stores the hash-
 // to-number mapping.
 func WriteHeader(db ethdb.KeyValueWriter, header *types.Header) {
@@ -519,6 +570,21 @@ func ReadTermini(db ethdb.Reader, hash common.Hash) []common.Hash {
 	return hashes
 }
 
+// ReadTerminiE is like ReadTermini, but reports database and decoding failures
+// instead of treating them as missing termini. It returns nil, nil if the hash
+// is unknown.
+func ReadTerminiE(db ethdb.Reader, hash common.Hash) ([]common.Hash, error) {
+	data, err := readE(db, terminiKey(hash))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	hashes := []common.Hash{}
+	if err := rlp.DecodeBytes(data, &hashes); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
 // WriteHeadsHashes writes the heads hashes of the blockchain.
 func WriteTermini(db ethdb.KeyValueWriter, index common.Hash, hashes []common.Hash) {
 	log.Debug("WriteTermini:", "hashes:", hashes, "index:", index)
@@ -119,7 +119,9 @@ func NewSlice(db ethdb.Database, config *Config, txConfig *TxPoolConfig, txLooku
 		return nil, err
 	}
 
-	sl.CheckForBadHashAndRecover()
+	if err := sl.CheckForBadHashAndRecover(); err != nil {
+		return nil, err
+	}
 
 	if nodeCtx == common.ZONE_CTX {
 		go sl.asyncPendingHeaderLoop()
@@ -194,7 +196,7 @@ func (sl *Slice) Append(header *types.Header, domPendingHeader *types.Header, do
 	time5 := common.PrettyDuration(time.Since(start))
 
 	// Append the new block
-	err = sl.hc.Append(batch, block, newInboundEtxs.FilterToLocation(common.NodeLocation))
+	logs, err := sl.hc.AppendAndCollect(batch, block, newInboundEtxs.FilterToLocation(common.NodeLocation))
 	if err != nil {
 		return nil, false, err
 	}
@@ -242,6 +244,7 @@ func (sl *Slice) Append(header *types.Header, domPendingHeader *types.Header, do
 	if err := batch.Write(); err != nil {
 		return nil, false, err
 	}
+	sl.hc.CommitBlock(block, logs)
 	appendFinished := time.Since(start)
 	time11 := common.PrettyDuration(appendFinished)
 	bestPh, exist := sl.readPhCache(sl.bestPhKey)
@@ -1007,7 +1010,7 @@ func (sl *Slice) AddPendingEtxsRollup(pEtxsRollup types.PendingEtxsRollup) error
 	return nil
 }
 
-func (sl *Slice) CheckForBadHashAndRecover() {
+func (sl *Slice) CheckForBadHashAndRecover() error {
 	nodeCtx := common.NodeLocation.Context()
 	// Lookup the bad hashes list to see if we have it in the database
 	for _, fork := range BadHashes {
@@ -1025,12 +1028,15 @@ func (sl *Slice) CheckForBadHashAndRecover() {
 		// Node has a bad block in the database
 		if badBlock != nil {
 			// Start from the current tip and delete every block from the database until this bad hash block
-			sl.cleanCacheAndDatabaseTillBlock(badBlock.ParentHash())
+			if err := sl.cleanCacheAndDatabaseTillBlock(badBlock.ParentHash()); err != nil {
+				return err
+			}
 			if nodeCtx == common.PRIME_CTX {
 				sl.SetHeadBackToRecoveryState(nil, badBlock.ParentHash())
 			}
 		}
 	}
+	return nil
 }
 
 // SetHeadBackToRecoveryState sets the heads of the whole hierarchy to the recovery state
@@ -1052,11 +1058,11 @@ func (sl *Slice) SetHeadBackToRecoveryState(pendingHeader *types.Header, hash co
 
 // cleanCacheAndDatabaseTillBlock till delete all entries of header and other
 // data structures around slice until the given block hash
-func (sl *Slice) cleanCacheAndDatabaseTillBlock(hash common.Hash) {
+func (sl *Slice) cleanCacheAndDatabaseTillBlock(hash common.Hash) error {
 	currentHeader := sl.hc.CurrentHeader()
 	// If the hash is the current header hash, there is nothing to clean from the database
 	if hash == currentHeader.Hash() {
-		return
+		return nil
 	}
 	nodeCtx := common.NodeLocation.Context()
 	// slice caches
@@ -1067,9 +1073,9 @@ func (sl *Slice) cleanCacheAndDatabaseTillBlock(hash common.Hash) {
 	// headerchain caches
 	sl.hc.headerCache.Purge()
 	sl.hc.numberCache.Purge()
+	sl.hc.canonicalBlocks.Purge()
 	sl.hc.pendingEtxsRollup.Purge()
 	sl.hc.pendingEtxs.Purge()
-	rawdb.DeleteAllHeadsHashes(sl.sliceDb)
 	// bodydb caches
 	sl.hc.bc.blockCache.Purge()
 	sl.hc.bc.bodyCache.Purge()
@@ -1103,16 +1109,23 @@ func (sl *Slice) cleanCacheAndDatabaseTillBlock(hash common.Hash) {
 			break
 		}
 	}
+	// Only drop the cached ancestors and hash lists once the headers are gone,
+	// so that no lookup racing the deletion leaves a stale one behind
+	sl.hc.ancestorCache.Purge()
+	sl.hc.blockHashesCache.Purge()
 
 	sl.AddToBadHashesList(badHashes)
-	// Set the current header
+	// Set the current header, dropping the heads of the deleted blocks
 	currentHeader = sl.hc.GetHeaderByHash(hash)
-	sl.hc.currentHeader.Store(currentHeader)
+	if err := sl.hc.resetHeads(currentHeader); err != nil {
+		return fmt.Errorf("failed to reset heads to %s: %w", hash.String(), err)
+	}
 
 	// Recover the snaps
 	if nodeCtx == common.ZONE_CTX {
 		sl.hc.bc.processor.snaps, _ = snapshot.New(sl.sliceDb, sl.hc.bc.processor.stateCache.TrieDB(), sl.hc.bc.processor.cacheConfig.SnapshotLimit, currentHeader.Root(), true, true)
 	}
+	return nil
 }
 
 func (sl *Slice) GenerateRecoveryPendingHeader(pendingHeader *types.Header, checkPointHashes []common.Hash) error {
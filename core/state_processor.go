@@ -100,6 +100,13 @@ type CacheConfig struct {
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
 	Preimages           bool          // Whether to store preimage of trie key to the disk
+	WriteBatchSize      int           // Number of items bulk operations write per database batch
+	StrictTimestamps    bool          // Whether appended blocks must be strictly newer than their parent
+	VerifyTimeout       time.Duration // Time the engine may take to verify an appended header, zero for no limit
+	ParentWaitTimeout   time.Duration // Time an appended block may wait for its parent to be stored, zero for no wait
+	WarmHeaders         int           // Number of recent canonical headers to load into the cache on startup
+
+	ProtectedHashes map[common.Hash]bool // Finalized headers no reorg may drop off the canonical chain
 }
 
 // defaultCacheConfig are the default caching values if none are specified by the
@@ -109,6 +116,7 @@ var defaultCacheConfig = &CacheConfig{
 	TrieDirtyLimit: 256,
 	TrieTimeLimit:  5 * time.Minute,
 	SnapshotLimit:  256,
+	WriteBatchSize: 1024,
 }
 
 // StateProcessor is a basic Processor, which takes care of transitioning